@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// cameraInfo is what the api says about a camera.
+type cameraInfo struct {
+	ID string
+	streamInfo
+	Substream *streamInfo `json:",omitempty"`
+}
+
+type streamInfo struct {
+	State cameraState
+	Stats streamStats
+}
+
+func (c *camera) info() cameraInfo {
+	info := cameraInfo{ID: c.id, streamInfo: c.streamInfo()}
+	if c.sub != nil {
+		s := c.sub.streamInfo()
+		info.Substream = &s
+	}
+	return info
+}
+
+func (c *camera) streamInfo() streamInfo {
+	return streamInfo{State: c.getState(), Stats: c.stats.stats(time.Now())}
+}
+
+// serveCameras serves /api/cameras, a list of cameras and their states,
+// and /api/cameras/<id> for just the one.
+func serveCameras(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/cameras"), "/")
+	id, action, _ := strings.Cut(rest, "/")
+
+	if id == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "unknown method", http.StatusMethodNotAllowed)
+			return
+		}
+		list := []cameraInfo{}
+		for _, c := range allCameras() {
+			if c.addrAllowed(r.RemoteAddr) {
+				list = append(list, c.info())
+			}
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+		writeJSON(w, list)
+		return
+	}
+
+	c, ok := getCamera(id)
+	if !ok || !c.addrAllowed(r.RemoteAddr) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	switch action {
+	case "":
+		if r.Method != http.MethodGet {
+			http.Error(w, "unknown method", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, c.info())
+	case "ptz":
+		servePTZ(w, r, c)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// servePTZ moves the camera on POST, and lists its presets on GET.
+func servePTZ(w http.ResponseWriter, r *http.Request, c *camera) {
+	if !c.ptzEnabled || c.onvif == "" {
+		http.Error(w, errNoPTZ.Error(), http.StatusNotFound)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), onvifTimeout)
+	defer cancel()
+	switch r.Method {
+	case http.MethodGet:
+		presets, err := c.ptzPresets(ctx)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, presets)
+	case http.MethodPost:
+		var req ptzRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, "malformed request", http.StatusBadRequest)
+			return
+		}
+		switch {
+		case req.Action != "move" && req.Action != "stop" && req.Action != "goto" && req.Action != "setpreset":
+			http.Error(w, fmt.Sprintf("unknown ptz action %q", req.Action), http.StatusBadRequest)
+			return
+		case req.Action == "goto" && req.Preset == "":
+			http.Error(w, "no preset", http.StatusBadRequest)
+			return
+		}
+		result, err := c.ptzDo(ctx, req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if result == nil {
+			result = struct{}{}
+		}
+		writeJSON(w, result)
+	default:
+		http.Error(w, "unknown method", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("could not write json: %v", err)
+	}
+}
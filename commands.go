@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// the live view's data channel speaks a little json protocol. the browser
+// sends commands:
+//
+//	{"V": 1, "ID": "7", "Cmd": "record.start", "Args": {"Seconds": 30}}
+//
+// and we answer each with a reply or an error carrying the same ID:
+//
+//	{"V": 1, "ID": "7", "Type": "reply", "Result": {...}}
+//	{"V": 1, "ID": "7", "Type": "error", "Error": "already recording"}
+//
+// we also send unsolicited messages: a "status" every couple of seconds,
+// and an "event" for each event the viewer has subscribed to.
+//
+// a session can carry more than one camera, so commands name the camera
+// they're for and everything we send says which camera it's about. the
+// camera can be left out of commands on single camera sessions. a few
+// commands are about the session itself rather than any one camera:
+// "add" and "remove" cameras, and "answer" to an "offer" we send when
+// the session has to be renegotiated.
+//
+// the playback page speaks the same protocol to its player, with its own
+// commands, see playback.go.
+
+const protocolVersion = 1
+
+type message struct {
+	V      int
+	ID     string          `json:",omitempty"`
+	Camera string          `json:",omitempty"`
+	Cmd    string          `json:",omitempty"`
+	Args   json.RawMessage `json:",omitempty"`
+
+	Type   string      `json:",omitempty"` // reply, error, status, event or offer
+	Event  string      `json:",omitempty"`
+	Result interface{} `json:",omitempty"`
+	Data   interface{} `json:",omitempty"`
+	Error  string      `json:",omitempty"`
+}
+
+type statusMessage struct {
+	Motion       float64
+	Threshold    float64
+	CameraMotion bool // from the camera's own detection, over onvif
+	Armed        bool
+	Recording    bool
+	Substream    bool
+	State        cameraState
+	Stats        streamStats
+}
+
+// events viewers can subscribe to.
+type motionEvent struct {
+	Moving bool
+	Motion float64
+}
+
+type recordingEvent struct {
+	Recording bool
+	Name      string
+}
+
+type armedEvent struct {
+	Armed bool
+}
+
+var events = map[string]bool{
+	"motion":    true,
+	"recording": true,
+	"armed":     true,
+	"state":     true, // data is a cameraState
+}
+
+const maxManualRecording = time.Hour
+
+// handle runs a command from the session's data channel and sends back
+// the reply.
+func (s *session) handle(buf []byte) {
+	var req message
+	err := json.Unmarshal(buf, &req)
+	if err != nil {
+		s.send(message{V: protocolVersion, Type: "error", Error: "malformed message"})
+		return
+	}
+	reply := func(result interface{}, err error) {
+		msg := message{V: protocolVersion, ID: req.ID, Camera: req.Camera, Type: "reply", Result: result}
+		if err != nil {
+			msg.Type, msg.Error = "error", err.Error()
+		}
+		s.send(msg)
+	}
+	if req.V != protocolVersion {
+		reply(nil, fmt.Errorf("unsupported protocol version %d", req.V))
+		return
+	}
+
+	var args struct {
+		SDP webrtc.SessionDescription
+	}
+	switch req.Cmd {
+	case "answer":
+		if err := json.Unmarshal(req.Args, &args); err != nil {
+			reply(nil, errors.New("malformed answer"))
+			return
+		}
+		select {
+		case s.answers <- args.SDP:
+		default:
+		}
+		return
+
+	case "add", "remove":
+		// renegotiation needs the answer, which arrives on this same
+		// data channel, so don't hold it up.
+		go func() {
+			reply(nil, s.addRemove(req.Cmd, req.Camera))
+		}()
+		return
+	}
+
+	s.mu.Lock()
+	v, ok := s.viewers[req.Camera]
+	if req.Camera == "" && len(s.viewers) == 1 {
+		for _, v = range s.viewers {
+			ok = true
+		}
+	}
+	s.mu.Unlock()
+	if !ok {
+		reply(nil, fmt.Errorf("not watching camera %q", req.Camera))
+		return
+	}
+	req.Camera = v.c.id
+	reply(v.run(req.Cmd, req.Args))
+}
+
+func (s *session) addRemove(cmd, id string) error {
+	if cmd == "remove" {
+		err := s.remove(id)
+		if err != nil {
+			return err
+		}
+		return s.renegotiate()
+	}
+
+	c, ok := getCamera(id)
+	if !ok || !c.addrAllowed(s.remoteAddr) {
+		return fmt.Errorf("no camera %q", id)
+	}
+	_, err := s.attach(c)
+	if err != nil {
+		return err
+	}
+	return s.renegotiate()
+}
+
+func (v *viewer) run(cmd string, rawargs json.RawMessage) (interface{}, error) {
+	c := v.c
+	var args struct {
+		Seconds float64
+		Events  []string
+		Sub     bool
+	}
+	if len(rawargs) > 0 {
+		err := json.Unmarshal(rawargs, &args)
+		if err != nil {
+			return nil, fmt.Errorf("malformed args for %s", cmd)
+		}
+	}
+
+	switch cmd {
+	case "record.start":
+		d := time.Duration(args.Seconds * float64(time.Second))
+		if d <= 0 {
+			d = time.Minute
+		}
+		if d > maxManualRecording {
+			d = maxManualRecording
+		}
+		return nil, c.startRecording(context.Background(), d)
+
+	case "record.stop":
+		c.stopRecording()
+		return nil, nil
+
+	case "snapshot":
+		name, err := c.snapshot()
+		if err != nil {
+			return nil, err
+		}
+		return struct{ Name string }{name}, nil
+
+	case "substream":
+		if args.Sub && c.sub == nil {
+			return nil, errors.New("no substream configured")
+		}
+		v.switchStream(args.Sub)
+		return nil, nil
+
+	case "arm", "disarm":
+		c.setArmed(cmd == "arm")
+		return nil, nil
+
+	case "subscribe", "unsubscribe":
+		for _, e := range args.Events {
+			if !events[e] {
+				return nil, fmt.Errorf("unknown event %q", e)
+			}
+		}
+		c.Lock()
+		if v.events == nil {
+			v.events = map[string]bool{}
+		}
+		for _, e := range args.Events {
+			if cmd == "subscribe" {
+				v.events[e] = true
+			} else {
+				delete(v.events, e)
+			}
+		}
+		c.Unlock()
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown command %q", cmd)
+}
+
+func sendMessage(dc *webrtc.DataChannel, msg message) {
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("unexpected error from json.Marshal: %v", err)
+		return
+	}
+	// errors here mean the viewer is going away. it'll clean up after
+	// itself once its connection is closed.
+	dc.SendText(string(buf))
+}
+
+// emit sends an event to the viewers that subscribed to it.
+func (c *camera) emit(event string, data interface{}) {
+	owner := c
+	if c.parent != nil {
+		owner = c.parent
+	}
+	owner.RLock()
+	var ss []*session
+	for v := range owner.viewers {
+		if v.events[event] {
+			ss = append(ss, v.s)
+		}
+	}
+	owner.RUnlock()
+
+	msg := message{V: protocolVersion, Camera: owner.id, Type: "event", Event: event, Data: data}
+	for _, s := range ss {
+		s.send(msg)
+	}
+}
+
+func (c *camera) setArmed(armed bool) {
+	c.Lock()
+	c.armed = armed
+	c.Unlock()
+	c.emit("armed", armedEvent{Armed: armed})
+}
+
+// switchStream moves v between the camera's main stream and its
+// substream. v gets the new stream's cached GOP so it can switch without
+// waiting for a keyframe.
+func (v *viewer) switchStream(sub bool) {
+	c := v.c
+	c.Lock()
+	if v.sub == sub {
+		c.Unlock()
+		return
+	}
+	v.sub = sub
+	v.live = false
+	c.Unlock()
+	v.goLive()
+}
+
+// snapshot saves the latest keyframe as a jpeg next to the recordings and
+// returns its name relative to outDir.
+func (c *camera) snapshot() (string, error) {
+	if len(ffmpegCommand) == 0 {
+		return "", errors.New("ffmpeg disabled")
+	}
+
+	c.RLock()
+	var key []byte
+	if len(c.gop.frames) > 0 {
+		key = c.gop.frames[0].data
+	}
+	c.RUnlock()
+	if key == nil {
+		return "", errors.New("no video yet")
+	}
+
+	name, err := c.newRecordingFilename("jpg")
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, ffmpegCommand[0], append(ffmpegCommand[1:],
+		"-f", "h264",
+		"-i", "-",
+		"-frames:v", "1",
+		"-y", name,
+	)...)
+	cmd.Stdin = bytes.NewReader(key)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if debug {
+			log.Printf("ffmpeg: %s", out)
+		}
+		return "", fmt.Errorf("could not take snapshot: %v", err)
+	}
+
+	rel, err := filepath.Rel(outDir, name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dnvr discover finds onvif cameras with ws-discovery and prints a
+// sources config for them.
+
+const wsDiscoveryAddr = "239.255.255.250:3702"
+
+func discoverMain(args []string) {
+	fs := flag.NewFlagSet("discover", flag.ExitOnError)
+	user := fs.String("user", "", "camera username")
+	pass := fs.String("pass", "", "camera password")
+	addr := fs.String("addr", wsDiscoveryAddr, "address to send the probe to")
+	timeout := fs.Duration("timeout", 3*time.Second, "how long to wait for cameras to answer")
+	fs.Parse(args)
+
+	devices, err := probe(*addr, *timeout)
+	if err != nil {
+		log.Fatalf("could not probe for cameras: %v", err)
+	}
+	if len(devices) == 0 {
+		log.Fatalf("no cameras found")
+	}
+
+	type source struct {
+		URL       string
+		Substream string `json:",omitempty"`
+		ONVIF     string
+	}
+	sources := map[string]source{}
+	for _, d := range devices {
+		u, err := url.Parse(d.XAddr)
+		if err != nil {
+			log.Printf("%s: %v", d.XAddr, err)
+			continue
+		}
+		if *user != "" {
+			u.User = url.UserPassword(*user, *pass)
+		}
+		xaddr := u.String()
+		streams, err := deviceStreams(context.Background(), xaddr)
+		if err != nil {
+			log.Printf("%s: %v", d.XAddr, err)
+			continue
+		}
+		if len(streams) == 0 {
+			log.Printf("%s: no h.264 streams", d.XAddr)
+			continue
+		}
+		src := source{URL: streams[0], ONVIF: xaddr}
+		if len(streams) > 1 {
+			src.Substream = streams[len(streams)-1]
+		}
+		name := d.name()
+		for i := 2; ; i++ {
+			if _, ok := sources[name]; !ok {
+				break
+			}
+			name = fmt.Sprintf("%s-%d", d.name(), i)
+		}
+		sources[name] = src
+	}
+
+	out, _ := json.MarshalIndent(struct{ Sources map[string]source }{sources}, "", "\t")
+	fmt.Printf("%s\n", out)
+}
+
+// deviceStreams returns a camera's h.264 stream urls, biggest first,
+// with credentials from xaddr.
+func deviceStreams(ctx context.Context, xaddr string) ([]string, error) {
+	media, err := onvifService(ctx, xaddr, "media")
+	if err != nil {
+		return nil, err
+	}
+	profiles, err := onvifProfiles(ctx, media)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(profiles, func(i, j int) bool {
+		return profiles[i].Width*profiles[i].Height > profiles[j].Width*profiles[j].Height
+	})
+	var streams []string
+	for _, p := range profiles {
+		if p.Codec != "" && !strings.EqualFold(p.Codec, "H264") {
+			continue
+		}
+		uri, err := onvifStreamURI(ctx, media, p.Token)
+		if err != nil {
+			log.Printf("%s: %v", p.Token, err)
+			continue
+		}
+		uri, err = withUserinfo(uri, xaddr)
+		if err != nil {
+			continue
+		}
+		streams = append(streams, uri)
+	}
+	return streams, nil
+}
+
+// device is a camera that answered a probe.
+type device struct {
+	XAddr  string // device service
+	Scopes []string
+}
+
+// name makes a source name for the device, from its onvif name scope if
+// it has one, or its address.
+func (d device) name() string {
+	for _, s := range d.Scopes {
+		if n := strings.TrimPrefix(s, "onvif://www.onvif.org/name/"); n != s && n != "" {
+			if n, err := url.PathUnescape(n); err == nil {
+				return strings.ToLower(strings.NewReplacer(" ", "-", "/", "-").Replace(n))
+			}
+		}
+	}
+	u, err := url.Parse(d.XAddr)
+	if err != nil {
+		return d.XAddr
+	}
+	return strings.NewReplacer(".", "-", ":", "-").Replace(u.Hostname())
+}
+
+// probe sends a ws-discovery probe for network video transmitters to addr
+// and collects the answers until timeout.
+func probe(addr string, timeout time.Duration) ([]device, error) {
+	raddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	msgID := fmt.Sprintf("uuid:%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:])
+	msg := `<?xml version="1.0" encoding="UTF-8"?>` +
+		`<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:a="http://schemas.xmlsoap.org/ws/2004/08/addressing">` +
+		`<s:Header><a:Action s:mustUnderstand="1">http://schemas.xmlsoap.org/ws/2005/04/discovery/Probe</a:Action>` +
+		`<a:MessageID>` + msgID + `</a:MessageID>` +
+		`<a:ReplyTo><a:Address>http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous</a:Address></a:ReplyTo>` +
+		`<a:To s:mustUnderstand="1">urn:schemas-xmlsoap-org:ws:2005:04:discovery</a:To></s:Header>` +
+		`<s:Body><Probe xmlns="http://schemas.xmlsoap.org/ws/2005/04/discovery">` +
+		`<d:Types xmlns:d="http://schemas.xmlsoap.org/ws/2005/04/discovery" xmlns:dn="http://www.onvif.org/ver10/network/wsdl">dn:NetworkVideoTransmitter</d:Types>` +
+		`</Probe></s:Body></s:Envelope>`
+	// udp is lossy, so say it twice.
+	for i := 0; i < 2; i++ {
+		if _, err := conn.WriteToUDP([]byte(msg), raddr); err != nil {
+			return nil, err
+		}
+	}
+
+	seen := map[string]bool{}
+	var devices []device
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1<<16)
+	for {
+		conn.SetReadDeadline(deadline)
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			return devices, err
+		}
+		var env struct {
+			RelatesTo string `xml:"Header>RelatesTo"`
+			Matches   []struct {
+				XAddrs string
+				Scopes string
+			} `xml:"Body>ProbeMatches>ProbeMatch"`
+		}
+		if xml.Unmarshal(buf[:n], &env) != nil || env.RelatesTo != msgID {
+			continue
+		}
+		for _, m := range env.Matches {
+			xaddr := pickXAddr(strings.Fields(m.XAddrs), from.IP)
+			if xaddr == "" || seen[xaddr] {
+				continue
+			}
+			seen[xaddr] = true
+			devices = append(devices, device{XAddr: xaddr, Scopes: strings.Fields(m.Scopes)})
+		}
+	}
+	return devices, nil
+}
+
+// pickXAddr chooses among a device's addresses, preferring the one it
+// answered from. cameras often list link-local or ipv6 addresses first.
+func pickXAddr(xaddrs []string, from net.IP) string {
+	for _, x := range xaddrs {
+		if u, err := url.Parse(x); err == nil && net.ParseIP(u.Hostname()).Equal(from) {
+			return x
+		}
+	}
+	if len(xaddrs) > 0 {
+		return xaddrs[0]
+	}
+	return ""
+}
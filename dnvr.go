@@ -5,6 +5,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -22,13 +23,10 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/deepch/vdk/av"
-	"github.com/deepch/vdk/codec/h264parser"
-	"github.com/deepch/vdk/format/rtsp"
 	"github.com/pion/webrtc/v3"
-	"github.com/pion/webrtc/v3/pkg/media"
 )
 
 var (
@@ -36,32 +34,141 @@ var (
 	outDir        string
 	ffmpegCommand = []string{}
 	config        = struct {
-		Sources map[string]struct {
-			URL    string
-			Record bool
-			Motion float64
-			ACL    []netip.Prefix
+		MaxViewers int // across all cameras, 0 means no limit
+
+		// if set, the rtsp listener speaks rtsps.
+		RTSPCert string // pem file
+		RTSPKey  string // pem file
+
+		// usernames and passwords the rtsp listener asks for. anyone can
+		// connect if there are none. these are ours, not the cameras'.
+		RTSPUsers map[string]string
+
+		Sources map[string]sourceConfig
+
+		// publishing over whip to /whip/<id> with Token as the bearer
+		// token makes a camera with Source's settings, if there isn't one
+		// called <id> already. off if Token is unset.
+		WHIP struct {
+			Token  string
+			Source sourceConfig
 		}
 	}{}
 )
 
-var cameras = map[string]*camera{}
+type sourceConfig struct {
+	URL        string  // rtsp://, rtsps://, rtmp: or whip: for devices that push, or file:
+	Type       string  // rtsp (default), mjpeg or snapshot-poll
+	Interval   float64 // seconds between snapshot-polls, 1 if unset
+	Record     bool
+	Motion     float64
+	ACL        []netip.Prefix
+	MaxViewers int
+	Talkback   bool   // camera has an onvif audio backchannel
+	Substream  string // url of a lower quality stream
+	Transport  string // tcp (default), udp, udp-multicast or auto
+	CA         string // pem file to trust for rtsps, see cameraTLSConfig
+	SkipVerify bool   // don't check rtsps certificates at all
+
+	// seconds without video before reconnecting, 10 if unset.
+	StallTimeout float64
+
+	// for rtmp: sources, which push to
+	// rtmp://<dnvr>/live/<id>?key=<StreamKey>, and whip: sources,
+	// which publish to /whip/<id> with it as their bearer token.
+	StreamKey string
+
+	Loop bool // for file: sources, start over at the end
+
+	// onvif device service url, with credentials, e.g.
+	// http://admin:pw@10.0.0.5/onvif/device_service
+	ONVIF string
+	PTZ   bool // camera can pan, tilt or zoom, over onvif
+
+	// start recordings on the camera's own motion and line
+	// detection events, over onvif. works alongside Motion, or
+	// instead of it with Motion unset.
+	ONVIFMotion bool
+}
+
+// cameras are the configured sources, plus any published over whip since.
+var cameras = struct {
+	sync.RWMutex
+	m map[string]*camera
+}{m: map[string]*camera{}}
+
+func getCamera(id string) (*camera, bool) {
+	cameras.RLock()
+	defer cameras.RUnlock()
+	c, ok := cameras.m[id]
+	return c, ok
+}
+
+// allCameras returns the cameras in no particular order.
+func allCameras() []*camera {
+	cameras.RLock()
+	defer cameras.RUnlock()
+	cams := make([]*camera, 0, len(cameras.m))
+	for _, c := range cameras.m {
+		cams = append(cams, c)
+	}
+	return cams
+}
 
 type camera struct {
-	id        string
-	src       string
-	track     *webrtc.TrackLocalStaticSample
-	ffin      io.Writer
-	ffout     io.Reader
-	threshold float64 // TODO it would be nice to "autotune" this.
-	acl       []netip.Prefix
-
-	// object lock protects concurrent access to all three following
-	// fields. they are independent.
+	lastFrame int64 // unix nanoseconds, accessed atomically. first for alignment.
+
+	id         string
+	src        string
+	ffin       io.Writer
+	ffout      io.Reader
+	threshold  float64 // TODO it would be nice to "autotune" this.
+	acl        []netip.Prefix
+	maxViewers int
+	talkback   bool
+	talk       sync.Mutex // held while someone's talking to the camera
+	transport  string
+	udpFailed  bool        // auto gave up on udp
+	tlsConfig  *tls.Config // for rtsps, may be nil
+
+	stallReconnect time.Duration // see watchFrames
+	stats          statsTracker
+
+	kind         string        // source type, "" for rtsp
+	pollInterval time.Duration // for snapshot-poll
+	loop         bool          // for file: sources
+
+	// for rtmp and whip sources, which wait for someone to push to them.
+	// publishers send something to read from them until they stop.
+	streamKey string
+	published chan func(context.Context) error
+	stop      context.CancelFunc // for whip cameras made by a publish, until it gets through
+
+	onvif       string // device service url
+	ptzEnabled  bool
+	ptz         ptzControl
+	onvifMotion bool // see watchEvents
+
+	// substreams are fed to the parent camera's viewers.
+	parent *camera
+	sub    *camera
+
+	// object lock protects concurrent access to all following fields.
+	// they are independent. a substream's gop and sinks are protected
+	// by its parent's lock instead.
 	sync.RWMutex
-	record       io.Writer
-	datachannels []*webrtc.DataChannel
-	motion       float64
+	record  io.Writer
+	recStop chan struct{} // closed to stop the current recording
+	recEnd  time.Time     // when the current recording ends
+	armed   bool          // whether motion starts recordings
+	viewers map[*viewer]bool
+	players int // recordings played over webrtc, and rtsp sessions playing
+	motion  float64
+	gop     gopCache
+	sinks   map[*frameSink]bool // rtsp clients
+	state   cameraState
+
+	cameraMotion bool // the camera's own detection sees something
 }
 
 var index = template.Must(template.New("index").Parse(`
@@ -94,7 +201,7 @@ video {
 	position: relative;
 }
 .online {}
-.offline {
+.offline, .down {
 	border: solid 10px red;
 }
 .video span {
@@ -105,6 +212,80 @@ video {
 	text-shadow: 0px 0px 10px black;
 	margin: 15px;
 }
+.video button {
+	font-size: 20px;
+	border-radius: 50%;
+	border: none;
+	opacity: 0.6;
+	margin: 2px;
+}
+.video button.talk {
+	position: absolute;
+	bottom: 50px;
+	right: 15px;
+	font-size: 24px;
+}
+.video button.talking {
+	background: #ffc825;
+	opacity: 1;
+}
+.video .ptz {
+	position: absolute;
+	bottom: 100px;
+	right: 15px;
+	display: grid;
+	grid-template-columns: repeat(3, auto);
+	visibility: hidden;
+}
+.video:hover .ptz {
+	visibility: visible;
+}
+.video .ptz select {
+	grid-column: 1/4;
+}
+.video .tools {
+	position: absolute;
+	top: 0;
+	left: 0;
+	margin: 10px;
+	visibility: hidden;
+}
+.video:hover .tools {
+	visibility: visible;
+}
+.video .stats {
+	position: absolute;
+	bottom: 50px;
+	left: 0;
+	margin: 15px;
+	font-family: monospace;
+	color: #ffc825;
+	text-shadow: 0px 0px 10px black;
+	visibility: hidden;
+}
+.video:hover .stats {
+	visibility: visible;
+}
+.video.recording span:after {
+	content: "⏺";
+	color: red;
+	margin: 4px;
+}
+.video.recording .record, .video.disarmed .arm {
+	background: #ffc825;
+	opacity: 1;
+}
+#hidden {
+	position: fixed;
+	bottom: 0;
+	left: 0;
+	z-index: 1;
+}
+#hidden button {
+	font-family: monospace;
+	opacity: 0.6;
+	margin: 2px;
+}
 .video.moving span:before {
 	content: "👋";
 	margin: 4px;
@@ -124,7 +305,10 @@ video {
 
 <script>
 let debug = true;
-let sources = {{.}};
+let sources = {{.Sources}};
+let talkback = {{.Talkback}} || [];
+let ptz = {{.PTZ}} || [];
+let substreams = {{.Substream}} || [];
 let draggedVideo = null;
 
 function handleDragEnd(e) {
@@ -155,24 +339,397 @@ function handleDragOver(e) {
 	e.preventDefault();
 }
 
-async function connect(id, pc) {
+// all the cameras share one peer connection and one data channel.
+// cameras can be added to and removed from it later on, which has the
+// server send us a new offer over the data channel.
+let pc = null;
+let dc = null;
+let lastID = 0;
+let pending = {};
+
+async function connect() {
+	pc = new RTCPeerConnection();
+	// one transceiver per camera, in the same order as the cameras we
+	// ask for.
+	for (const id of sources) {
+		pc.addTransceiver('video', {direction: 'recvonly'});
+	}
+	let talkers = {};
+	for (const id of sources) {
+		if (talkback.includes(id)) {
+			// audio goes out only while the button is held.
+			let t = pc.addTransceiver('audio', {direction: 'sendonly'});
+			cameras[id].sender = t.sender;
+			talkers[id] = t;
+		}
+	}
+
+	pc.oniceconnectionstatechange = () => {
+		console.log("grid: " + pc.iceConnectionState)
+		let online = pc.iceConnectionState === "connected" || pc.iceConnectionState === "completed";
+		for (const id in cameras) {
+			cameras[id].div.classList.toggle("online", online && cameras[id].live);
+			cameras[id].div.classList.toggle("offline", !online || !cameras[id].live);
+		}
+	}
+
+	pc.ontrack = e => {
+		let cam = cameras[e.streams[0].id];
+		if (!cam) {
+			return;
+		}
+		cam.v.srcObject = e.streams[0];
+		cam.live = true;
+		cam.div.classList.add("online");
+		cam.div.classList.remove("offline");
+		e.streams[0].onremovetrack = () => {
+			cam.live = false;
+			cam.div.classList.remove("online");
+			cam.div.classList.add("offline");
+		};
+		subscribe(cam);
+	}
+
+	dc = pc.createDataChannel("d");
+	dc.onopen = () => {
+		for (const id in cameras) {
+			if (cameras[id].live) {
+				subscribe(cameras[id]);
+			}
+		}
+	};
+	dc.onmessage = e => receive(JSON.parse(e.data));
+
 	let offer = await pc.createOffer();
-	pc.setLocalDescription(offer);
-	console.log(id + " offer: ");
+	await pc.setLocalDescription(offer);
+	console.log("grid offer: ");
 	console.log(offer.sdp);
-	// TODO use template string once this is out of the go source file.
-	let res = await fetch('/'+id, {method: 'post', body: JSON.stringify(offer)});
+	let mids = {};
+	for (const id in talkers) {
+		mids[talkers[id].mid] = id;
+	}
+	let res = await fetch('/api/grid', {method: 'post', body: JSON.stringify({
+		Offer: offer,
+		Cameras: sources,
+		Talkback: mids,
+	})});
+	if (!res.ok) {
+		// e.g. too many viewers.
+		let err = await res.text();
+		for (const id in cameras) {
+			cameras[id].div.classList.add("offline");
+			cameras[id].span.innerText = id + ": " + err;
+		}
+		pc.close();
+		return;
+	}
 	let answer = await res.json();
 	await pc.setRemoteDescription(answer);
-	console.log(id + " answer: ");
+	console.log("grid answer: ");
 	console.log(answer.sdp);
 	await pc.addIceCandidate(null);
 }
 
-function addVideo(id) {
-	let pc = new RTCPeerConnection();
-	pc.addTransceiver('video');
+// renegotiate answers an offer from the server after cameras were added
+// or removed.
+async function renegotiate(offer) {
+	await pc.setRemoteDescription(offer);
+	let answer = await pc.createAnswer();
+	await pc.setLocalDescription(answer);
+	dc.send(JSON.stringify({V: 1, Cmd: "answer", Args: {SDP: answer}}));
+}
+
+function subscribe(cam) {
+	if (dc.readyState !== "open" || cam.subscribed) {
+		return;
+	}
+	cam.subscribed = true;
+	tool(cam, "subscribe", {Events: ["motion", "recording", "armed", "state"]});
+}
+
+function receive(msg) {
+	let cam = cameras[msg.Camera];
+	switch (msg.Type) {
+	case "reply":
+	case "error":
+		let p = pending[msg.ID];
+		delete pending[msg.ID];
+		if (!p) {
+			console.log(msg.Camera + ": " + (msg.Error || "unexpected reply"));
+		} else if (msg.Type === "reply") {
+			p.resolve(msg.Result);
+		} else {
+			p.reject(new Error(msg.Error));
+		}
+		break;
+	case "offer":
+		renegotiate(msg.Data);
+		break;
+	case "status":
+		if (cam) {
+			update(cam, msg.Data);
+		}
+		break;
+	case "event":
+		console.log(msg.Camera + ": " + msg.Event + " " + JSON.stringify(msg.Data));
+		if (!cam) {
+			break;
+		}
+		switch (msg.Event) {
+		case "motion":
+			cam.div.classList.toggle("moving", msg.Data.Moving);
+			break;
+		case "recording":
+			cam.div.classList.toggle("recording", msg.Data.Recording);
+			break;
+		case "armed":
+			cam.div.classList.toggle("disarmed", !msg.Data.Armed);
+			break;
+		case "state":
+			showState(cam, msg.Data);
+			break;
+		}
+		break;
+	}
+}
+
+// hide takes a camera off the connection and puts it in the list of
+// hidden cameras, from where it can be brought back.
+async function hide(cam) {
+	try {
+		await command(null, "remove", undefined, cam.id);
+	} catch (err) {
+		cam.span.innerText = cam.id + ": " + err.message;
+		return;
+	}
+	cam.live = false;
+	cam.subscribed = false;
+	cam.div.style.display = "none";
+	let b = document.createElement("button");
+	b.innerText = cam.id;
+	b.title = "show " + cam.id;
+	b.onclick = async () => {
+		try {
+			await command(null, "add", undefined, cam.id);
+		} catch (err) {
+			b.title = err.message;
+			return;
+		}
+		b.remove();
+		cam.div.style.display = "";
+	};
+	document.getElementById("hidden").appendChild(b);
+}
 
+async function talk(sender, button, on) {
+	if (!on) {
+		button.classList.remove("talking");
+		sender.replaceTrack(null);
+		return;
+	}
+	button.classList.add("talking");
+	// TODO keep the mic open between presses? browsers make a fuss
+	// every time we ask.
+	let mic = await navigator.mediaDevices.getUserMedia({audio: true});
+	if (!button.classList.contains("talking")) {
+		mic.getTracks().forEach(t => t.stop());
+		return;
+	}
+	sender.replaceTrack(mic.getAudioTracks()[0]);
+}
+
+// command sends cmd for the camera over the data channel and resolves
+// with the result from the reply. cam is null for commands about the
+// connection itself, which name the camera they're about in camera.
+function command(cam, cmd, args, camera) {
+	let id = String(++lastID);
+	dc.send(JSON.stringify({V: 1, ID: id, Camera: cam ? cam.id : camera, Cmd: cmd, Args: args}));
+	return new Promise((resolve, reject) => {
+		pending[id] = {resolve: resolve, reject: reject};
+	});
+}
+
+async function tool(cam, cmd, args) {
+	try {
+		return await command(cam, cmd, args);
+	} catch (err) {
+		cam.span.innerText = cam.id + ": " + err.message;
+	}
+}
+
+function addTools(cam, div) {
+	let tools = document.createElement("div");
+	tools.classList.add("tools");
+	let add = (label, title, cls, onclick) => {
+		let b = document.createElement("button");
+		b.innerText = label;
+		b.title = title;
+		b.classList.add(cls);
+		b.onclick = onclick;
+		tools.appendChild(b);
+		return b;
+	};
+	add("⏺", "record", "record", () => {
+		if (div.classList.contains("recording")) {
+			tool(cam, "record.stop");
+		} else {
+			tool(cam, "record.start", {Seconds: 60});
+		}
+	});
+	add("📷", "snapshot", "snapshot", async () => {
+		let r = await tool(cam, "snapshot");
+		if (r) {
+			window.open("/recordings/" + r.Name);
+		}
+	});
+	add("🔕", "disarm motion recording", "arm", () => {
+		tool(cam, div.classList.contains("disarmed") ? "arm" : "disarm");
+	});
+	add("✕", "hide", "hide", () => hide(cam));
+	if (substreams.includes(cam.id)) {
+		cam.subButton = add("SD", "switch stream quality", "sub", () => {
+			tool(cam, "substream", {Sub: cam.subButton.innerText === "SD"});
+		});
+	}
+	div.appendChild(tools);
+}
+
+async function ptzCall(cam, req) {
+	let res = await fetch('/api/cameras/' + encodeURIComponent(cam.id) + '/ptz', {method: 'post', body: JSON.stringify(req)});
+	if (!res.ok) {
+		cam.span.innerText = cam.id + ": " + await res.text();
+		return null;
+	}
+	return res.json();
+}
+
+async function loadPresets(cam, select) {
+	let res = await fetch('/api/cameras/' + encodeURIComponent(cam.id) + '/ptz');
+	if (!res.ok) {
+		return;
+	}
+	let presets = await res.json();
+	select.innerHTML = "";
+	let o = document.createElement("option");
+	o.innerText = "presets";
+	o.value = "";
+	select.appendChild(o);
+	for (const p of presets) {
+		o = document.createElement("option");
+		o.innerText = p.Name || p.Token;
+		o.value = p.Token;
+		select.appendChild(o);
+	}
+}
+
+// addPTZ adds buttons that move the camera while they're held, and a list
+// of presets.
+function addPTZ(cam, div) {
+	let panel = document.createElement("div");
+	panel.classList.add("ptz");
+	let add = (label, title) => {
+		let b = document.createElement("button");
+		b.innerText = label;
+		b.title = title;
+		panel.appendChild(b);
+		return b;
+	};
+	let hold = (label, title, move) => {
+		let b = add(label, title);
+		let moving = false;
+		b.addEventListener('pointerdown', () => {
+			moving = true;
+			ptzCall(cam, Object.assign({Action: "move"}, move));
+		});
+		let stop = () => {
+			if (moving) {
+				moving = false;
+				ptzCall(cam, {Action: "stop"});
+			}
+		};
+		b.addEventListener('pointerup', stop);
+		b.addEventListener('pointerleave', stop);
+	};
+	let gap = () => panel.appendChild(document.createElement("span"));
+	hold("＋", "zoom in", {Zoom: 0.5});
+	hold("▲", "tilt up", {Tilt: 0.5});
+	hold("－", "zoom out", {Zoom: -0.5});
+	hold("◀", "pan left", {Pan: -0.5});
+	let save = add("★", "save position as a preset");
+	hold("▶", "pan right", {Pan: 0.5});
+	gap();
+	hold("▼", "tilt down", {Tilt: -0.5});
+	gap();
+
+	let select = document.createElement("select");
+	select.onchange = () => {
+		if (select.value) {
+			ptzCall(cam, {Action: "goto", Preset: select.value});
+		}
+	};
+	panel.appendChild(select);
+	save.onclick = async () => {
+		let name = prompt("preset name");
+		if (name && await ptzCall(cam, {Action: "setpreset", Name: name})) {
+			loadPresets(cam, select);
+		}
+	};
+	loadPresets(cam, select);
+	div.appendChild(panel);
+}
+
+function update(cam, s) {
+	if (s.Motion > s.Threshold || s.CameraMotion) {
+		cam.div.classList.add("moving");
+	} else {
+		cam.div.classList.remove("moving");
+	}
+	cam.div.classList.toggle("recording", s.Recording);
+	cam.div.classList.toggle("disarmed", !s.Armed);
+	if (cam.subButton) {
+		cam.subButton.innerText = s.Substream ? "HD" : "SD";
+	}
+	cam.span.innerText = cam.id;
+	if (debug) {
+		cam.span.innerText += " (" + s.Threshold + ") " + s.Motion.toFixed(2);
+	}
+	showState(cam, s.State);
+	showStats(cam, s.Stats);
+}
+
+function showStats(cam, st) {
+	let text = st.FPS.toFixed(1) + " fps, " + (st.Bitrate / 1e6).toFixed(2) + " Mbps";
+	if (st.GOP) {
+		text += ", gop " + st.GOP + " (" + st.KeyframeInterval.toFixed(1) + "s)";
+	}
+	if (st.MaxGap > 0.5) {
+		text += ", gap " + st.MaxGap.toFixed(1) + "s";
+	}
+	if (st.RTP && (st.RTP.Lost || st.RTP.Late)) {
+		text += ", " + st.RTP.Lost + " lost, " + st.RTP.Late + " late";
+	}
+	cam.stats.innerText = text;
+}
+
+// showState says why a camera isn't streaming, if it isn't.
+function showState(cam, st) {
+	let down = st.State !== "streaming";
+	cam.div.classList.toggle("down", down);
+	if (!down) {
+		return;
+	}
+	let text = cam.id + ": " + st.State;
+	if (st.Error) {
+		text += " (" + st.Error + ")";
+	}
+	if (st.Retry) {
+		let secs = Math.max(0, Math.round((new Date(st.Retry) - new Date()) / 1000));
+		text += ", retrying in " + secs + "s";
+	}
+	cam.span.innerText = text;
+}
+
+function addVideo(id) {
 	let v = document.createElement("video");
 	v.setAttribute("playsinline", ""); 
 	v.autoplay = true;
@@ -182,6 +739,7 @@ function addVideo(id) {
 	let div = document.createElement("div");
 	div.id = id;
 	div.classList.add("video");
+	div.classList.add("offline");
 	div.draggable = true;
 	div.addEventListener('dragstart', handleDragStart, false);
 	div.addEventListener('dragend', handleDragEnd, false);
@@ -189,58 +747,54 @@ function addVideo(id) {
 	div.addEventListener('drop', handleDrop);
 	div.appendChild(v);
 	let span = document.createElement("span");
+	span.innerText = id;
 	div.appendChild(span);
+	let stats = document.createElement("div");
+	stats.classList.add("stats");
+	div.appendChild(stats);
 	document.body.appendChild(div);
 
-	pc.oniceconnectionstatechange = () => {
-		console.log(id + ": " + pc.iceConnectionState)
-		if (pc.iceConnectionState === "connected" || pc.iceConnectionState === "completed") {
-			div.classList.add("online");
-			div.classList.remove("offline");
-		} else {
-			div.classList.remove("online");
-			div.classList.add("offline");
-		}
-	}
-
-	pc.ontrack = e => {
-		// TODO check if it's actually a video. do something about audio?
-		v.srcObject = e.streams[0];
-	}
-
-	let dc = pc.createDataChannel("d");
-	dc.onmessage = e => {
-		let msg = JSON.parse(e.data);
-		if (msg.Motion > msg.Threshold) {
-			div.classList.add("moving");
-		} else {
-			div.classList.remove("moving");
-		}
-		span.innerText = id;
-		if (debug) {
-			span.innerText += " (" + msg.Threshold + ") " + msg.Motion.toFixed(2);
-		}
-	};
-
-	connect(id, pc);
-
-	return {
+	let cam = {
 		id: id,
 		v: v,
 		div: div,
 		span: span,
-		pc: pc,
-		dc: dc,
+		stats: stats,
+		live: false,
+		subscribed: false,
+		sender: null,
+	};
+	addTools(cam, div);
+	if (ptz.includes(id)) {
+		addPTZ(cam, div);
+	}
+
+	if (talkback.includes(id)) {
+		let button = document.createElement("button");
+		button.innerText = "🎤";
+		button.title = "hold to talk";
+		button.classList.add("talk");
+		button.addEventListener('pointerdown', () => talk(cam.sender, button, true));
+		button.addEventListener('pointerup', () => talk(cam.sender, button, false));
+		button.addEventListener('pointerleave', () => talk(cam.sender, button, false));
+		div.appendChild(button);
 	}
+
+	return cam;
 }
 
-let cameras = [];
+let cameras = {};
 
 function main() {
 	sources.sort();
-	for (const i in sources) {
-		cameras.push(addVideo(sources[i]));
+	for (const id of sources) {
+		cameras[id] = addVideo(id);
 	}
+	// after the videos, so the first one still gets the big tile.
+	let hidden = document.createElement("div");
+	hidden.id = "hidden";
+	document.body.appendChild(hidden);
+	connect();
 }
 
 document.addEventListener("DOMContentLoaded", main);
@@ -251,7 +805,7 @@ document.addEventListener("DOMContentLoaded", main);
 func answer(w http.ResponseWriter, r *http.Request) {
 	id := r.URL.Path[1:]
 
-	c, ok := cameras[id]
+	c, ok := getCamera(id)
 	if !ok {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
@@ -268,53 +822,110 @@ func answer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	s, err := newSession(r.RemoteAddr)
 	if err != nil {
 		http.Error(w, "bad times", http.StatusInternalServerError)
 		return
 	}
-
-	err = pc.SetRemoteDescription(offer)
+	buf, err := s.answer(offer, []*camera{c}, func(string) *camera { return c })
 	if err != nil {
+		s.close()
+		log.Printf("%s: %v", r.RemoteAddr, err)
+		if errors.Is(err, errTooManyViewers) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
 		http.Error(w, "bad times", http.StatusInternalServerError)
 		return
 	}
 
-	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
-		c.Lock()
-		c.datachannels = append(c.datachannels, dc)
-		c.Unlock()
-	})
+	w.Write(buf)
+}
+
+// answerGrid negotiates a single peer connection carrying all the
+// cameras the browser asks for, for the grid view.
+func answerGrid(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "unknown method", http.StatusMethodNotAllowed)
+		return
+	}
 
-	_, err = pc.AddTrack(c.track)
+	var req struct {
+		Offer    webrtc.SessionDescription
+		Cameras  []string          // in the order of the offer's video transceivers
+		Talkback map[string]string // audio transceiver mid to camera id
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
 		http.Error(w, "bad times", http.StatusInternalServerError)
 		return
 	}
 
-	gatherCandidates := webrtc.GatheringCompletePromise(pc)
+	var cams []*camera
+	for _, id := range req.Cameras {
+		if c, ok := getCamera(id); ok && c.addrAllowed(r.RemoteAddr) {
+			cams = append(cams, c)
+		}
+	}
+	if len(cams) == 0 {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
 
-	answer, err := pc.CreateAnswer(nil)
+	s, err := newSession(r.RemoteAddr)
 	if err != nil {
 		http.Error(w, "bad times", http.StatusInternalServerError)
 		return
 	}
-
-	err = pc.SetLocalDescription(answer)
+	buf, err := s.answer(req.Offer, cams, func(mid string) *camera {
+		c, ok := getCamera(req.Talkback[mid])
+		if !ok || !c.addrAllowed(r.RemoteAddr) {
+			return nil
+		}
+		return c
+	})
 	if err != nil {
+		s.close()
+		log.Printf("%s: %v", r.RemoteAddr, err)
+		if errors.Is(err, errTooManyViewers) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
 		http.Error(w, "bad times", http.StatusInternalServerError)
 		return
 	}
 
-	<-gatherCandidates
+	w.Write(buf)
+}
 
-	buf, err := json.Marshal(pc.LocalDescription())
+// negotiate answers offer with track added to pc, and returns the answer
+// as json once all ice candidates have been gathered.
+func negotiate(pc *webrtc.PeerConnection, offer webrtc.SessionDescription, track webrtc.TrackLocal) ([]byte, error) {
+	err := pc.SetRemoteDescription(offer)
 	if err != nil {
-		http.Error(w, "bad times", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
-	w.Write(buf)
+	_, err = pc.AddTrack(track)
+	if err != nil {
+		return nil, err
+	}
+
+	gatherCandidates := webrtc.GatheringCompletePromise(pc)
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = pc.SetLocalDescription(answer)
+	if err != nil {
+		return nil, err
+	}
+
+	<-gatherCandidates
+
+	return json.Marshal(pc.LocalDescription())
 }
 
 func (c *camera) addrAllowed(addr string) bool {
@@ -339,13 +950,27 @@ func serve(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodHead:
 	case http.MethodGet:
-		var ids []string
-		for id, c := range cameras {
+		var page struct {
+			Sources   []string
+			Talkback  []string
+			Substream []string
+			PTZ       []string
+		}
+		for _, c := range allCameras() {
 			if c.addrAllowed(r.RemoteAddr) {
-				ids = append(ids, id)
+				page.Sources = append(page.Sources, c.id)
+				if c.talkback {
+					page.Talkback = append(page.Talkback, c.id)
+				}
+				if c.sub != nil {
+					page.Substream = append(page.Substream, c.id)
+				}
+				if c.ptzEnabled && c.onvif != "" {
+					page.PTZ = append(page.PTZ, c.id)
+				}
 			}
 		}
-		index.Execute(w, ids)
+		index.Execute(w, page)
 		log.Printf("%s	%s	%s\n", r.RemoteAddr, r.Method, r.URL)
 	case http.MethodPost:
 		answer(w, r)
@@ -363,38 +988,33 @@ func (c *camera) broadcast(ctx context.Context) {
 		default:
 		}
 
+		stats := c.stats.stats(time.Now())
+		var substats streamStats
+		if c.sub != nil {
+			substats = c.sub.stats.stats(time.Now())
+		}
 		c.RLock()
-		// answer() only appends, so copying slice header is fine here
-		dcs := c.datachannels
-		stat := struct {
-			Motion    float64
-			Threshold float64
-		}{
-			Motion:    c.motion,
-			Threshold: c.threshold,
+		ss := map[*session]statusMessage{}
+		for v := range c.viewers {
+			st := stats
+			if v.sub {
+				st = substats
+			}
+			ss[v.s] = statusMessage{
+				Motion:       c.motion,
+				Threshold:    c.threshold,
+				CameraMotion: c.cameraMotion,
+				Armed:        c.armed,
+				Recording:    c.recStop != nil,
+				Substream:    v.sub,
+				State:        c.state,
+				Stats:        st,
+			}
 		}
 		c.RUnlock()
 
-		buf, err := json.Marshal(stat)
-		if err != nil {
-			// We don't expect this to fix itself, so bail out here.
-			// Fatalf might also be appropriate here.
-			log.Printf("unexpected error from json.Marshal: %v", err)
-			return
-		}
-
-		if len(dcs) == 0 {
-			continue
-		}
-
-		for i := 0; i < len(dcs); i++ {
-			err := dcs[i].SendText(string(buf))
-			if err != nil {
-				dcs = append(dcs[:i], dcs[i+1:]...)
-				c.Lock()
-				c.datachannels = append(c.datachannels[:i], c.datachannels[i+1:]...)
-				c.Unlock()
-			}
+		for s, stat := range ss {
+			s.send(message{V: protocolVersion, Camera: c.id, Type: "status", Data: stat})
 		}
 	}
 }
@@ -456,6 +1076,7 @@ func (c *camera) detectMotion(ctx context.Context, r io.Reader) {
 	buf := make([]byte, 320*240*1)
 	prev := make([]byte, 320*240*1)
 	movingFrames := 0
+	moving := false
 	for {
 		select {
 		case <-ctx.Done():
@@ -499,48 +1120,98 @@ func (c *camera) detectMotion(ctx context.Context, r io.Reader) {
 			movingFrames = 0
 		}
 
-		c.RLock()
-		recording := c.record != io.Discard
-		c.RUnlock()
+		if movingFrames == 6 {
+			c.emit("motion", motionEvent{Moving: true, Motion: motion})
+		} else if movingFrames == 0 && moving {
+			c.emit("motion", motionEvent{Moving: false, Motion: motion})
+		}
+		moving = movingFrames > 5
 
-		// We're moving and not recording. Start recording.
-		if movingFrames > 5 && !recording {
-			log.Printf("motion in %v", c.id)
-			// TODO always keep N frames in some ring buffer to record
-			// a few seconds before motion. can probably have a Writer
-			// in c.record that does that and wrap the ffmpeg pipe or
-			// Discard.
-			c.startRecording(ctx, 1*time.Minute)
+		if moving {
+			c.recordMotion(ctx)
 		}
 	}
 }
 
-func (c *camera) newRecordingFilename() (string, error) {
+// how long recordings go on for after the last motion. a var so tests
+// needn't wait.
+var motionRecording = time.Minute
+
+// recordMotion starts a recording because something moved, or keeps the
+// current one going, unless the camera is disarmed or doesn't record.
+func (c *camera) recordMotion(ctx context.Context) {
+	c.RLock()
+	armed := c.armed && c.record != nil
+	c.RUnlock()
+	if !armed || c.extendRecording(motionRecording) {
+		return
+	}
+
+	// We're moving and not recording. Start recording.
+	log.Printf("motion in %v", c.id)
+	// TODO always keep N frames in some ring buffer to record
+	// a few seconds before motion. can probably have a Writer
+	// in c.record that does that and wrap the ffmpeg pipe or
+	// Discard.
+	err := c.startRecording(ctx, motionRecording)
+	if err != nil && err != errAlreadyRecording {
+		log.Printf("%s: %v", c.id, err)
+	}
+}
+
+// extendRecording makes the current recording, if there is one, go on
+// for at least d more. It reports whether there was one.
+func (c *camera) extendRecording(d time.Duration) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.recStop == nil {
+		return false
+	}
+	if until := time.Now().Add(d); until.After(c.recEnd) {
+		c.recEnd = until
+	}
+	return true
+}
+
+func (c *camera) newRecordingFilename(ext string) (string, error) {
 	now := time.Now()
 	dir := filepath.Join(outDir, now.Format("2006-01-02"))
 	err := os.MkdirAll(dir, 0700)
 	if err != nil {
 		return "", err
 	}
-	name := fmt.Sprintf("%s-%s.mp4", time.Now().Format("150405"), c.id)
+	name := fmt.Sprintf("%s-%s.%s", time.Now().Format("150405"), c.id, ext)
 	return filepath.Join(dir, name), nil
 }
 
-func (c *camera) startRecording(ctx context.Context, duration time.Duration) {
-	ctx, cancel := context.WithCancel(ctx)
+var errAlreadyRecording = errors.New("already recording")
 
-	name, err := c.newRecordingFilename()
-	if err != nil {
-		log.Printf("could not start recording %v in %v: %v", name, outDir, err)
-		c.record = io.Discard
-		return
+// startRecording records the camera to a new file for duration, or until
+// stopRecording is called.
+func (c *camera) startRecording(ctx context.Context, duration time.Duration) error {
+	if len(ffmpegCommand) == 0 {
+		return errors.New("ffmpeg disabled")
 	}
 
-	if len(ffmpegCommand) == 0 {
-		// no ffmpeg
-		return
+	c.Lock()
+	if c.recStop != nil {
+		c.Unlock()
+		return errAlreadyRecording
+	}
+	stop := make(chan struct{})
+	c.recStop = stop
+	c.recEnd = time.Now().Add(duration)
+	c.Unlock()
+
+	name, err := c.newRecordingFilename("mp4")
+	if err != nil {
+		c.Lock()
+		c.recStop = nil
+		c.Unlock()
+		return fmt.Errorf("could not start recording in %v: %v", outDir, err)
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
 	cmd := exec.CommandContext(ctx, ffmpegCommand[0], append(ffmpegCommand[1:],
 		"-f", "h264",
 		"-r", "10",
@@ -551,47 +1222,98 @@ func (c *camera) startRecording(ctx context.Context, duration time.Duration) {
 		name,
 	)...)
 	ffpipe, err := cmd.StdinPipe()
-	if err != nil {
-		log.Printf("could not start recording %v: %v", name, err)
-		// If we got here something is messed up - ffmpeg is broken or
-		c.record = io.Discard
-		return
+	if err == nil {
+		err = cmd.Start()
 	}
-	err = cmd.Start()
 	if err != nil {
-		log.Printf("could not start recording %v: %v", name, err)
-		c.record = io.Discard
-		return
+		// If we got here something is messed up - ffmpeg is broken or
+		// missing.
+		c.Lock()
+		c.recStop = nil
+		c.Unlock()
+		cancel()
+		return fmt.Errorf("could not start recording %v: %v", name, err)
 	}
 
 	c.Lock()
-	defer c.Unlock()
+	idle := c.record
 	c.record = ffpipe
+	c.Unlock()
+	c.emit("recording", recordingEvent{Recording: true, Name: name})
 
 	go func() {
-		time.Sleep(duration)
+		// the end can be pushed back while we wait, by extendRecording.
+		timer := time.NewTimer(duration)
+		defer timer.Stop()
+	wait:
+		for {
+			select {
+			case <-timer.C:
+				c.RLock()
+				left := time.Until(c.recEnd)
+				c.RUnlock()
+				if left <= 0 {
+					break wait
+				}
+				timer.Reset(left)
+			case <-stop:
+				break wait
+			case <-ctx.Done():
+				break wait
+			}
+		}
 		c.Lock()
-		defer c.Unlock()
-		c.record = io.Discard
+		c.record = idle
+		if c.recStop == stop {
+			c.recStop = nil
+		}
+		c.Unlock()
+		c.emit("recording", recordingEvent{Recording: false, Name: name})
+
 		ffpipe.Close()
 		go func() { time.Sleep(5 * time.Second); cancel() }()
 		err := cmd.Wait()
 		if err != nil {
 			log.Printf("error finishing recording %v: %v", name, err)
-			c.record = io.Discard
 		}
 	}()
+	return nil
+}
+
+// stopRecording stops the current recording, if there is one.
+func (c *camera) stopRecording() {
+	c.Lock()
+	defer c.Unlock()
+	if c.recStop != nil {
+		close(c.recStop)
+		c.recStop = nil
+	}
 }
 
+// stream reads from the camera until ctx is done, reconnecting with
+// backoff whenever the connection fails.
 func (c *camera) stream(ctx context.Context) {
 	suppresserrors := false
+	failures := 0
 	for {
-		ctx, cancel := context.WithCancel(ctx)
+		var pub func(context.Context) error
+		if c.published != nil {
+			// nothing to do until the device turns up.
+			c.setState(stateWaiting, nil, time.Time{})
+			select {
+			case <-ctx.Done():
+				return
+			case pub = <-c.published:
+			}
+		}
+
+		attempt, cancel := context.WithCancel(ctx)
 
 		c.ffin = ioutil.Discard
 		c.ffout = nil
-		if c.threshold != 0 && c.record != nil {
-			err := c.runffmpeg(ctx)
+		if c.threshold != 0 && c.record != nil && !c.jpegSource() {
+			// jpeg sources do their own, see readJPEGs.
+			err := c.runffmpeg(attempt)
 			if err != nil {
 				if !suppresserrors {
 					log.Printf("could not start ffmpeg: %v", err)
@@ -599,99 +1321,180 @@ func (c *camera) stream(ctx context.Context) {
 				}
 			} else {
 				suppresserrors = false
-				go c.detectMotion(ctx, c.ffout)
+				go c.detectMotion(attempt, c.ffout)
 			}
 		}
 
-		c.readRTSP(ctx)
+		c.setState(stateConnecting, nil, time.Time{})
+		atomic.StoreInt64(&c.lastFrame, 0)
+		c.stats.reset()
+		stalled := make(chan struct{})
+		go c.watchFrames(attempt, cancel, stalled)
+		var err error
+		switch {
+		case pub != nil:
+			err = pub(attempt)
+		case c.jpegSource():
+			err = c.readJPEGs(attempt)
+		case strings.HasPrefix(c.src, "file:"):
+			err = c.readFile(attempt)
+		default:
+			err = c.readRTSP(attempt)
+		}
 		cancel()
-		time.Sleep(10 * time.Second)
+		select {
+		case <-stalled:
+			err = fmt.Errorf("no video for %v", c.stallReconnect)
+		default:
+		}
+
+		if pub != nil {
+			// it's up to the device to come back.
+			c.setState(stateWaiting, err, time.Time{})
+			continue
+		}
+		if err == errEndOfFile {
+			c.setState(stateEnded, nil, time.Time{})
+			return
+		}
+
+		if atomic.LoadInt64(&c.lastFrame) != 0 {
+			// it worked for a while. start over.
+			failures = 0
+		}
+		state := failureState(err)
+		d := backoff(failures)
+		if state != stateBackingOff {
+			// retrying won't help until someone fixes something.
+			d = maxBackoff
+		}
+		failures++
+		c.setState(state, err, time.Now().Add(d))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(d):
+		}
 	}
 }
 
-func (c *camera) readRTSP(ctx context.Context) {
-	conn, err := rtsp.Dial(c.src)
-	if err != nil {
-		log.Printf("can not dial rtsp: %v", err)
-		return
+// readRTSP reads video from the camera until the connection fails.
+func (c *camera) readRTSP(ctx context.Context) error {
+	switch c.transport {
+	case "udp", "udp-multicast":
+		return c.readRTSPOver(ctx, c.transport)
+	case "auto":
+		if c.udpFailed {
+			break
+		}
+		err := c.readRTSPOver(ctx, "udp")
+		if err != errNoPackets {
+			return err
+		}
+		// most likely a firewall. stick with tcp from now on.
+		log.Printf("%s: nothing over udp, falling back to tcp", c.id)
+		c.udpFailed = true
 	}
-	defer conn.Close()
-	conn.RtpKeepAliveTimeout = 10 * time.Second
+	return c.readRTSPOver(ctx, "tcp")
+}
 
-	streams, err := conn.Streams()
-	if err != nil {
-		log.Printf("can not get streams: %v", err)
-		return
+// newCamera sets up a camera for a source. It doesn't start it.
+func newCamera(id string, src sourceConfig) (*camera, error) {
+	c := &camera{
+		id:         id,
+		src:        src.URL,
+		threshold:  src.Motion,
+		acl:        src.ACL,
+		maxViewers: src.MaxViewers,
+		talkback:   src.Talkback,
+		transport:  strings.ToLower(src.Transport),
+		armed:      true,
+
+		stallReconnect: defaultStallReconnect,
+		onvif:          src.ONVIF,
+		ptzEnabled:     src.PTZ,
+		onvifMotion:    src.ONVIFMotion,
+		loop:           src.Loop,
 	}
-
-	if len(streams) < 1 || streams[0].Type() != av.H264 {
-		log.Printf("first for %s stream not usable", c.src)
-		return
+	c.kind = strings.ToLower(src.Type)
+	if c.kind == "rtsp" {
+		c.kind = ""
 	}
-
-	header := make([]byte, 0, 1500)
-	header = append(header, []byte{0x00, 0x00, 0x00, 0x01}...)
-	header = append(header, streams[0].(h264parser.CodecData).SPS()...)
-	header = append(header, []byte{0x00, 0x00, 0x00, 0x01}...)
-	header = append(header, streams[0].(h264parser.CodecData).PPS()...)
-	header = append(header, []byte{0x00, 0x00, 0x00, 0x01}...)
-	var position time.Duration
-
-	for {
-		p, err := conn.ReadPacket()
-		if err != nil {
-			log.Printf("can not read packet: %v", err)
-			return
+	if !sourceTypes[c.kind] {
+		return nil, fmt.Errorf("unknown source type %q", src.Type)
+	}
+	if c.kind == sourceSnapshot {
+		c.pollInterval = defaultSnapshotInterval
+		if src.Interval > 0 {
+			c.pollInterval = time.Duration(src.Interval * float64(time.Second))
 		}
-		if p.Idx != 0 {
-			continue
+		if c.stallReconnect < 3*c.pollInterval {
+			// slow polls aren't stalls.
+			c.stallReconnect = 3 * c.pollInterval
 		}
+	}
+	if src.StallTimeout > 0 {
+		c.stallReconnect = time.Duration(src.StallTimeout * float64(time.Second))
+	}
+	if c.onvifMotion && c.onvif == "" {
+		return nil, errors.New("ONVIFMotion needs an ONVIF url")
+	}
+	if !transports[c.transport] {
+		return nil, fmt.Errorf("unknown transport %q", src.Transport)
+	}
+	var err error
+	c.tlsConfig, err = cameraTLSConfig(src.CA, src.SkipVerify)
+	if err != nil {
+		return nil, fmt.Errorf("could not load ca: %w", err)
+	}
 
-		if len(header)+len(p.Data[4:]) > cap(header) {
-			b := make([]byte, len(header), len(header)+len(p.Data[4:]))
-			copy(b, header)
-			header = b
+	if src.Record {
+		c.record = ioutil.Discard
+	}
+
+	if strings.HasPrefix(c.src, "rtmp:") || strings.HasPrefix(c.src, "whip:") {
+		if src.StreamKey == "" {
+			return nil, errors.New("rtmp and whip sources need a StreamKey")
 		}
+		c.streamKey = src.StreamKey
+		c.published = make(chan func(context.Context) error)
+	}
 
-		// For WebRTC we're fine only doing this on key frames but ffmpeg seems
-		// to like that all frames have sps & pps. Maybe there's a better way
-		// to fix this.
-		// TODO change ReadPacket() so it takes in a buffer to avoid this copy?
-		buf := header
-		buf = buf[:len(header)+len(p.Data[4:])]
-		copy(buf[len(header):], p.Data[4:])
+	if src.Substream != "" {
+		c.sub = &camera{
+			id:        id + "/sub",
+			src:       src.Substream,
+			transport: c.transport,
+			tlsConfig: c.tlsConfig,
+			parent:    c,
 
-		// TODO combine both and tee to ffmpeg in detectMotion()
-		_, err = c.ffin.Write(buf)
-		if err != nil {
-			log.Printf("can not write frame: %v", err)
-			return
-		}
-		c.RLock()
-		if c.record != nil {
-			_, err = c.record.Write(buf)
-		}
-		c.RUnlock()
-		if err != nil {
-			log.Printf("can not write frame: %v", err)
-			return
+			stallReconnect: c.stallReconnect,
 		}
+	}
+	return c, nil
+}
 
-		err = c.track.WriteSample(media.Sample{
-			Data:     buf,
-			Duration: p.Time - position,
-		})
-		if err != nil && err != io.ErrClosedPipe {
-			log.Printf("can not write frame to webrtc track: %v", err)
-			return
-		}
-		position = p.Time
+// start connects to the camera, and keeps at it until ctx is done.
+func (c *camera) start(ctx context.Context) {
+	if c.sub != nil {
+		go c.sub.stream(ctx)
+	}
+	go c.stream(ctx)
+	go c.broadcast(ctx)
+	if c.onvifMotion {
+		go c.watchEvents(ctx)
 	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "discover" {
+		discoverMain(os.Args[2:])
+		return
+	}
+
 	httpaddr := flag.String("http", ":http", "http listen address")
 	rtspaddr := flag.String("rtsp", ":rtsp", "rtsp listen address")
+	rtmpaddr := flag.String("rtmp", ":1935", "rtmp listen address, used if any sources are rtmp")
 	configpath := flag.String("config", "./sources.json", "path to config file")
 	ffmpegcmd := flag.String("ffmpeg", "ffmpeg", "command line to run ffmpeg")
 	flag.BoolVar(&debug, "debug", false, "debug mode")
@@ -711,37 +1514,39 @@ func main() {
 
 	ctx := context.Background()
 
+	pushed := false
 	for id, src := range config.Sources {
-		track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: "video/h264"}, "v", "v")
+		c, err := newCamera(id, src)
 		if err != nil {
-			log.Fatalf("could not make track for source %s: %v", id, err)
-		}
-
-		c := &camera{
-			id:        id,
-			src:       src.URL,
-			track:     track,
-			threshold: src.Motion,
-			acl:       src.ACL,
+			log.Fatalf("%s: %v", id, err)
 		}
-
-		if src.Record {
-			c.record = ioutil.Discard
+		if strings.HasPrefix(c.src, "rtmp:") {
+			pushed = true
 		}
-
-		go c.stream(ctx)
-		go c.broadcast(ctx)
-		cameras[id] = c
+		cameras.m[id] = c
+		c.start(ctx)
 	}
 
 	http.Handle("/", http.HandlerFunc(serve))
+	http.Handle("/api/grid", http.HandlerFunc(answerGrid))
+	http.Handle("/api/cameras", http.HandlerFunc(serveCameras))
+	http.Handle("/api/cameras/", http.HandlerFunc(serveCameras))
+	http.Handle("/playback/", http.HandlerFunc(servePlayback))
+	http.Handle("/recordings/", http.HandlerFunc(serveRecordings))
+	http.Handle("/whip/", http.HandlerFunc(serveWHIP))
 	go func() {
-		log.Fatal(http.ListenAndServe(*httpaddr, nil))
+		log.Fatal(http.ListenAndServe(*httpaddr, rtspTunnelling(http.DefaultServeMux)))
 	}()
 
 	go func() {
-		log.Fatal(rtspProxyListenAndServe(*rtspaddr))
+		log.Fatal(rtspListenAndServe(*rtspaddr))
 	}()
 
+	if pushed {
+		go func() {
+			log.Fatal(rtmpListenAndServe(*rtmpaddr))
+		}()
+	}
+
 	select {}
 }
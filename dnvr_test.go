@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestMotionKeepsRecording(t *testing.T) {
+	defer func(cmd []string, dir string, d time.Duration) {
+		ffmpegCommand, outDir, motionRecording = cmd, dir, d
+	}(ffmpegCommand, outDir, motionRecording)
+	// an ffmpeg that takes whatever it's given.
+	ffmpegCommand = []string{"sh", "-c", "cat >/dev/null", "ffmpeg"}
+	outDir = t.TempDir()
+	motionRecording = 300 * time.Millisecond
+
+	c := &camera{id: "cam", armed: true, record: ioutil.Discard}
+	recording := func() bool {
+		c.RLock()
+		defer c.RUnlock()
+		return c.recStop != nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c.recordMotion(ctx)
+	if !recording() {
+		t.Fatal("motion didn't start a recording")
+	}
+	time.Sleep(200 * time.Millisecond)
+	c.recordMotion(ctx)
+	time.Sleep(200 * time.Millisecond)
+	if !recording() {
+		t.Fatal("recording stopped despite more motion")
+	}
+	time.Sleep(500 * time.Millisecond)
+	if recording() {
+		t.Error("still recording after the motion stopped")
+	}
+
+	c.armed = false
+	c.recordMotion(ctx)
+	if recording() {
+		t.Error("disarmed camera recorded")
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/format/mp4"
+)
+
+// file: sources play an mp4 or a raw h.264 file as if it were a camera,
+// for working on dnvr without one. mp4s are paced by their timestamps,
+// raw h.264 by the frame rate in its sps, or 25fps if it doesn't say.
+
+const defaultFileFPS = 25
+
+// errEndOfFile is for file sources that have played to the end and
+// don't loop.
+var errEndOfFile = errors.New("end of file")
+
+// fileFrames reads a file's frames in order, with their timestamps.
+type fileFrames interface {
+	next() (f frame, t time.Duration, err error) // io.EOF at the end
+	rewind() error
+	Close() error
+}
+
+// readFile plays the camera's file until it ends or ctx is done.
+func (c *camera) readFile(ctx context.Context) error {
+	name, err := filePath(c.src)
+	if err != nil {
+		return err
+	}
+	var ff fileFrames
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".mp4", ".m4v", ".mov":
+		ff, err = openMP4(name)
+	default:
+		ff, err = openRawH264(name)
+	}
+	if err != nil {
+		return err
+	}
+	defer ff.Close()
+
+	// each frame is due at start plus its time in the file, plus the
+	// length of the loops before it.
+	start := time.Now()
+	var offset, prev, t0 time.Duration
+	step := time.Second / defaultFileFPS
+	frames := 0 // since the last rewind
+	first := true
+	for {
+		f, t, err := ff.next()
+		if err == io.EOF {
+			if !c.loop {
+				return errEndOfFile
+			}
+			if frames == 0 {
+				return errors.New("no video in file")
+			}
+			if err := ff.rewind(); err != nil {
+				return err
+			}
+			offset, frames = prev+step, 0
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if first {
+			t0, first = t, false
+		}
+		at := offset + t - t0
+		if at > prev {
+			f.duration = at - prev
+			if frames > 0 {
+				step = f.duration
+			}
+		} else {
+			f.duration = step
+		}
+		prev = at
+		frames++
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Until(start.Add(at))):
+		}
+		if err := c.writeFrame(f); err != nil {
+			return fmt.Errorf("can not write frame: %w", err)
+		}
+	}
+}
+
+// filePath returns the path in a file: url, which may be relative, as in
+// file:clips/door.mp4, or absolute, as in file:///home/me/door.mp4.
+func filePath(src string) (string, error) {
+	u, err := url.Parse(src)
+	if err != nil {
+		return "", err
+	}
+	if u.Opaque != "" {
+		return u.Opaque, nil
+	}
+	return filepath.FromSlash(u.Host + u.Path), nil
+}
+
+type mp4Frames struct {
+	f       *os.File
+	demuxer *mp4.Demuxer
+	codec   h264parser.CodecData
+	idx     int8
+}
+
+func openMP4(name string) (*mp4Frames, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	m := &mp4Frames{f: f, demuxer: mp4.NewDemuxer(f), idx: -1}
+	streams, err := m.demuxer.Streams()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	for i, s := range streams {
+		if codec, ok := s.(h264parser.CodecData); ok {
+			m.idx, m.codec = int8(i), codec
+			break
+		}
+	}
+	if m.idx < 0 {
+		f.Close()
+		return nil, fmt.Errorf("%w: no h.264 video in %s", errUnsupportedCodec, name)
+	}
+	return m, nil
+}
+
+func (m *mp4Frames) next() (frame, time.Duration, error) {
+	for {
+		pkt, err := m.demuxer.ReadPacket()
+		if err != nil {
+			return frame{}, 0, err
+		}
+		if pkt.Idx != m.idx {
+			continue
+		}
+		return frame{
+			// ffmpeg wants the sps and pps on every frame.
+			data:     avccToAnnexB(pkt.Data, m.codec, true),
+			keyframe: pkt.IsKeyFrame,
+		}, pkt.Time, nil
+	}
+}
+
+func (m *mp4Frames) rewind() error {
+	return m.demuxer.SeekToTime(0)
+}
+
+func (m *mp4Frames) Close() error {
+	return m.f.Close()
+}
+
+// rawH264Frames is an annex b file, read into memory up front. It's for
+// short clips.
+type rawH264Frames struct {
+	aus      [][][]byte
+	sps, pps []byte
+	i        int
+	interval time.Duration
+}
+
+func openRawH264(name string) (*rawH264Frames, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	r := &rawH264Frames{
+		aus:      accessUnits(splitAnnexB(b)),
+		interval: time.Second / defaultFileFPS,
+	}
+	for _, au := range r.aus {
+		for _, nalu := range au {
+			if nalu[0]&0x1f != naluSPS {
+				continue
+			}
+			if info, err := h264parser.ParseSPS(nalu); err == nil && info.FPS > 0 {
+				r.interval = time.Second / time.Duration(info.FPS)
+			}
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no h.264 sps in %s", errUnsupportedCodec, name)
+}
+
+func (r *rawH264Frames) next() (frame, time.Duration, error) {
+	for r.i < len(r.aus) {
+		au := r.aus[r.i]
+		t := time.Duration(r.i) * r.interval
+		r.i++
+		var rest [][]byte
+		for _, nalu := range au {
+			switch nalu[0] & 0x1f {
+			case naluSPS:
+				r.sps = nalu
+			case naluPPS:
+				r.pps = nalu
+			case naluAUD:
+			default:
+				rest = append(rest, nalu)
+			}
+		}
+		if len(rest) == 0 || r.sps == nil || r.pps == nil {
+			continue
+		}
+		return frame{
+			data:     annexB(rest, r.sps, r.pps),
+			keyframe: isKeyframe(rest),
+		}, t, nil
+	}
+	return frame{}, 0, io.EOF
+}
+
+func (r *rawH264Frames) rewind() error {
+	r.i = 0
+	return nil
+}
+
+func (r *rawH264Frames) Close() error {
+	return nil
+}
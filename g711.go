@@ -0,0 +1,104 @@
+package main
+
+// g.711 companding, for cameras whose backchannel speaks a different law
+// than the browser. see itu-t g.711 and the classic sun g711.c.
+
+const (
+	ulawBias = 0x84
+	ulawClip = 8159
+)
+
+func ulawToLinear(u byte) int16 {
+	u = ^u
+	t := (int(u&0x0f) << 3) + ulawBias
+	t <<= (u & 0x70) >> 4
+	if u&0x80 != 0 {
+		return int16(ulawBias - t)
+	}
+	return int16(t - ulawBias)
+}
+
+func alawToLinear(a byte) int16 {
+	a ^= 0x55
+	t := int(a&0x0f) << 4
+	seg := (a & 0x70) >> 4
+	switch seg {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t += 0x108
+		t <<= seg - 1
+	}
+	if a&0x80 != 0 {
+		return int16(t)
+	}
+	return int16(-t)
+}
+
+var (
+	ulawSegEnd = [8]int{0x3f, 0x7f, 0xff, 0x1ff, 0x3ff, 0x7ff, 0xfff, 0x1fff}
+	alawSegEnd = [8]int{0x1f, 0x3f, 0x7f, 0xff, 0x1ff, 0x3ff, 0x7ff, 0xfff}
+)
+
+func segment(v int, ends *[8]int) int {
+	for i, end := range ends {
+		if v <= end {
+			return i
+		}
+	}
+	return len(ends)
+}
+
+func linearToUlaw(s int16) byte {
+	v := int(s) >> 2
+	mask := byte(0xff)
+	if v < 0 {
+		v = -v
+		mask = 0x7f
+	}
+	if v > ulawClip {
+		v = ulawClip
+	}
+	v += ulawBias >> 2
+	seg := segment(v, &ulawSegEnd)
+	if seg >= 8 {
+		return 0x7f ^ mask
+	}
+	return (byte(seg<<4) | byte(v>>(seg+1))&0x0f) ^ mask
+}
+
+func linearToAlaw(s int16) byte {
+	v := int(s) >> 3
+	mask := byte(0xd5)
+	if v < 0 {
+		v = -v - 1
+		mask = 0x55
+	}
+	seg := segment(v, &alawSegEnd)
+	if seg >= 8 {
+		return 0x7f ^ mask
+	}
+	a := byte(seg << 4)
+	if seg < 2 {
+		a |= byte(v>>1) & 0x0f
+	} else {
+		a |= byte(v>>seg) & 0x0f
+	}
+	return a ^ mask
+}
+
+// transcodeG711 converts a payload between "PCMU" and "PCMA" in place.
+func transcodeG711(buf []byte, from, to string) {
+	if from == to {
+		return
+	}
+	for i, b := range buf {
+		if from == "PCMU" {
+			buf[i] = linearToAlaw(ulawToLinear(b))
+		} else {
+			buf[i] = linearToUlaw(alawToLinear(b))
+		}
+	}
+}
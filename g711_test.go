@@ -0,0 +1,108 @@
+package main
+
+import "testing"
+
+// values from the reference g711.c.
+
+func TestUlawToLinear(t *testing.T) {
+	for _, tt := range []struct {
+		u    byte
+		want int16
+	}{
+		{0x00, -32124},
+		{0x0f, -16764},
+		{0x70, -120},
+		{0x7e, -8},
+		{0x7f, 0},
+		{0x80, 32124},
+		{0xce, 988},
+		{0xfe, 8},
+		{0xff, 0},
+	} {
+		if got := ulawToLinear(tt.u); got != tt.want {
+			t.Errorf("ulawToLinear(%#02x) = %d, want %d", tt.u, got, tt.want)
+		}
+	}
+}
+
+func TestAlawToLinear(t *testing.T) {
+	for _, tt := range []struct {
+		a    byte
+		want int16
+	}{
+		{0x00, -5504},
+		{0x2a, -32256},
+		{0x55, -8},
+		{0x80, 5504},
+		{0xaa, 32256},
+		{0xd5, 8},
+		{0xfa, 1008},
+	} {
+		if got := alawToLinear(tt.a); got != tt.want {
+			t.Errorf("alawToLinear(%#02x) = %d, want %d", tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestLinearToUlaw(t *testing.T) {
+	for _, tt := range []struct {
+		s    int16
+		want byte
+	}{
+		{0, 0xff},
+		{-1, 0x7e},
+		{1000, 0xce},
+		{-1000, 0x4e},
+		{32767, 0x80},
+		{-32768, 0x00},
+	} {
+		if got := linearToUlaw(tt.s); got != tt.want {
+			t.Errorf("linearToUlaw(%d) = %#02x, want %#02x", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestLinearToAlaw(t *testing.T) {
+	for _, tt := range []struct {
+		s    int16
+		want byte
+	}{
+		{0, 0xd5},
+		{-1, 0x55},
+		{1000, 0xfa},
+		{-1000, 0x7a},
+		{32767, 0xaa},
+		{-32768, 0x2a},
+	} {
+		if got := linearToAlaw(tt.s); got != tt.want {
+			t.Errorf("linearToAlaw(%d) = %#02x, want %#02x", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestG711RoundTrip(t *testing.T) {
+	// every code decodes to a level that encodes back to it, apart from
+	// mu-law's negative zero.
+	for i := 0; i < 256; i++ {
+		u := byte(i)
+		if got := linearToUlaw(ulawToLinear(u)); got != u && u != 0x7f {
+			t.Errorf("ulaw %#02x came back as %#02x", u, got)
+		}
+		a := byte(i)
+		if got := linearToAlaw(alawToLinear(a)); got != a {
+			t.Errorf("alaw %#02x came back as %#02x", a, got)
+		}
+	}
+}
+
+func TestTranscodeG711(t *testing.T) {
+	buf := []byte{0xff, 0x80, 0x00, 0xce}
+	transcodeG711(buf, "PCMU", "PCMU")
+	if buf[3] != 0xce {
+		t.Fatalf("same law changed the payload: %x", buf)
+	}
+	transcodeG711(buf, "PCMU", "PCMA")
+	if want := []byte{0xd5, 0xaa, 0x2a, 0xfb}; string(buf) != string(want) {
+		t.Errorf("PCMU to PCMA = %x, want %x", buf, want)
+	}
+}
@@ -1,12 +1,34 @@
 module github.com/saljam/dnvr
 
-go 1.16
+go 1.18
 
 require (
 	github.com/deepch/vdk v0.0.0-20210523103705-5b25bda1a000
+	github.com/pion/interceptor v0.0.12
+	github.com/pion/rtcp v1.2.6
+	github.com/pion/rtp v1.6.5
 	github.com/pion/webrtc/v3 v3.0.29
+)
+
+require (
+	github.com/google/uuid v1.2.0 // indirect
+	github.com/pion/datachannel v1.4.21 // indirect
+	github.com/pion/dtls/v2 v2.0.9 // indirect
+	github.com/pion/ice/v2 v2.1.7 // indirect
+	github.com/pion/logging v0.2.2 // indirect
+	github.com/pion/mdns v0.0.5 // indirect
+	github.com/pion/randutil v0.1.0 // indirect
+	github.com/pion/sctp v1.7.12 // indirect
+	github.com/pion/sdp/v3 v3.0.4 // indirect
+	github.com/pion/srtp/v2 v2.0.2 // indirect
+	github.com/pion/stun v0.3.5 // indirect
+	github.com/pion/transport v0.12.3 // indirect
+	github.com/pion/turn/v2 v2.0.5 // indirect
+	github.com/pion/udp v0.1.1 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
 	golang.org/x/crypto v0.0.0-20210513164829-c07d793c2f9a // indirect
 	golang.org/x/net v0.0.0-20210525063256-abc453219eb5 // indirect
 	golang.org/x/sys v0.0.0-20210608053332-aa57babbf139 // indirect
+	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20200615113413-eeeca48fe776 // indirect
 )
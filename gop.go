@@ -0,0 +1,274 @@
+package main
+
+import (
+	"io"
+	"log"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// limits on how much of a GOP we keep around. cameras with very long
+// GOPs (or none at all) shouldn't be able to eat all our memory.
+const (
+	maxGOPFrames = 600
+	maxGOPBytes  = 16 << 20
+)
+
+// frame is one access unit in annex b form, with sps and pps prepended.
+type frame struct {
+	data     []byte
+	duration time.Duration
+	keyframe bool
+}
+
+// gopCache holds every frame since the most recent keyframe so that new
+// viewers can start decoding straight away instead of waiting for the
+// camera's next IDR.
+type gopCache struct {
+	frames []frame
+	size   int
+	n      int // frames ever cached, the last of which is frames[len(frames)-1]
+}
+
+// add appends f to the cache, starting over if f is a keyframe. The
+// cache keeps its own copy of f.data.
+func (g *gopCache) add(f frame) {
+	if f.keyframe {
+		g.frames = g.frames[:0]
+		g.size = 0
+	} else if len(g.frames) == 0 {
+		// haven't seen a keyframe yet, or we gave up on this GOP.
+		return
+	}
+	if len(g.frames) >= maxGOPFrames || g.size+len(f.data) > maxGOPBytes {
+		g.frames = g.frames[:0]
+		g.size = 0
+		return
+	}
+	f.data = append([]byte(nil), f.data...)
+	g.frames = append(g.frames, f)
+	g.size += len(f.data)
+	g.n++
+}
+
+// since returns copies of the cached frames from the nth one ever cached
+// on, or the whole cache if the nth has gone, along with the number to
+// ask for next time.
+func (g *gopCache) since(n int) ([]frame, int) {
+	first := g.n - len(g.frames)
+	if n < first {
+		n = first
+	}
+	return append([]frame(nil), g.frames[n-first:]...), g.n
+}
+
+// writeFrame hands a frame to everything that consumes the camera's
+// video: motion detection, the current recording and live viewers.
+func (c *camera) writeFrame(f frame) error {
+	c.gotFrame(f)
+	// TODO combine both and tee to ffmpeg in detectMotion()
+	_, err := c.ffin.Write(f.data)
+	if err != nil {
+		return err
+	}
+	c.RLock()
+	if c.record != nil {
+		_, err = c.record.Write(f.data)
+	}
+	c.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	// substreams go out to the viewers of their parent that asked for
+	// them.
+	owner, sub := c, false
+	if c.parent != nil {
+		owner, sub = c.parent, true
+	}
+	// writing to viewers' tracks can block, so it's done without the
+	// lock, to a copy of the list.
+	var live []*viewer
+	owner.Lock()
+	c.gop.add(f)
+	for s := range c.sinks {
+		s.send(f)
+	}
+	for v := range owner.viewers {
+		if v.live && v.sub == sub {
+			live = append(live, v)
+		}
+	}
+	owner.Unlock()
+	for _, v := range live {
+		err := v.track.WriteSample(media.Sample{
+			Data:     f.data,
+			Duration: f.duration,
+		})
+		if err != nil && err != io.ErrClosedPipe {
+			log.Printf("can not write frame to webrtc track: %v", err)
+		}
+	}
+	return nil
+}
+
+// bindNotifier lets us know when pion binds a track to its connection.
+// Samples written to the track before then are dropped.
+type bindNotifier struct {
+	*webrtc.TrackLocalStaticSample
+	bound func()
+}
+
+func (t bindNotifier) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	p, err := t.TrackLocalStaticSample.Bind(ctx)
+	if err == nil {
+		go t.bound()
+	}
+	return p, err
+}
+
+// trackLocal returns v's track for adding to its peer connection.
+func (v *viewer) trackLocal() webrtc.TrackLocal {
+	return bindNotifier{v.track, v.goLive}
+}
+
+// goLive sends v the cached GOP and then starts feeding it live frames.
+// The GOP is sent without holding the camera's lock, so it keeps going
+// until it has caught up with the frames that came in meanwhile.
+func (v *viewer) goLive() {
+	c := v.c
+	c.Lock()
+	if v.catching {
+		// the one already going will notice if v switched streams.
+		c.Unlock()
+		return
+	}
+	v.catching = true
+	c.Unlock()
+
+	var last *camera
+	next := 0
+	for {
+		c.Lock()
+		if v.detached || v.live {
+			v.catching = false
+			c.Unlock()
+			return
+		}
+		src := c
+		if v.sub && c.sub != nil {
+			src = c.sub
+		}
+		if src != last {
+			last, next = src, 0
+		}
+		var frames []frame
+		frames, next = src.gop.since(next)
+		if len(frames) == 0 {
+			v.live, v.catching = true, false
+			c.Unlock()
+			return
+		}
+		c.Unlock()
+
+		for _, f := range frames {
+			// squash the cached frames' timestamps together so the
+			// browser decodes them right away rather than lagging by a
+			// whole GOP.
+			err := v.track.WriteSample(media.Sample{
+				Data:     f.data,
+				Duration: time.Millisecond,
+			})
+			if err != nil && err != io.ErrClosedPipe {
+				log.Printf("can not write cached frame to webrtc track: %v", err)
+				break
+			}
+		}
+	}
+}
+
+// sinkBuffer is how many frames an rtsp client can fall behind by, on top
+// of the GOP it starts with, before it starts losing them.
+const sinkBuffer = 64
+
+// frameSink is a copy of a camera's frames for an rtsp client, which reads
+// them from frames at its own pace.
+type frameSink struct {
+	frames chan frame
+
+	// protected by the camera's lock.
+	dropping bool // fell behind, waiting for a keyframe to catch up
+}
+
+func (s *frameSink) send(f frame) {
+	if s.dropping && !f.keyframe {
+		return
+	}
+	f.data = append([]byte(nil), f.data...)
+	select {
+	case s.frames <- f:
+		s.dropping = false
+	default:
+		s.dropping = true
+	}
+}
+
+// addSink starts copying c's frames to a new sink, starting with the
+// cached GOP.
+func (c *camera) addSink() *frameSink {
+	owner := c
+	if c.parent != nil {
+		owner = c.parent
+	}
+	owner.Lock()
+	defer owner.Unlock()
+	s := &frameSink{frames: make(chan frame, maxGOPFrames+sinkBuffer)}
+	for _, f := range c.gop.frames {
+		// squashed together, as for webrtc viewers in goLive.
+		f.duration = time.Millisecond
+		s.frames <- f
+	}
+	if c.sinks == nil {
+		c.sinks = map[*frameSink]bool{}
+	}
+	c.sinks[s] = true
+	return s
+}
+
+func (c *camera) removeSink(s *frameSink) {
+	owner := c
+	if c.parent != nil {
+		owner = c.parent
+	}
+	owner.Lock()
+	defer owner.Unlock()
+	delete(c.sinks, s)
+}
+
+// parameterSets returns the sps and pps c's video started with, if it's
+// had any lately.
+func (c *camera) parameterSets() (sps, pps []byte) {
+	owner := c
+	if c.parent != nil {
+		owner = c.parent
+	}
+	owner.RLock()
+	defer owner.RUnlock()
+	if len(c.gop.frames) == 0 {
+		return nil, nil
+	}
+	for _, nalu := range splitAnnexB(c.gop.frames[0].data) {
+		switch nalu[0] & 0x1f {
+		case naluSPS:
+			sps = nalu
+		case naluPPS:
+			pps = nalu
+		}
+		if sps != nil && pps != nil {
+			break
+		}
+	}
+	return sps, pps
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/pion/rtp"
+)
+
+var startCode = []byte{0x00, 0x00, 0x00, 0x01}
+
+// avccToAnnexB converts length prefixed nal units, as found in mp4 and
+// flv, to annex b. If params is set the sps and pps are put in front.
+func avccToAnnexB(data []byte, codec h264parser.CodecData, params bool) []byte {
+	out := make([]byte, 0, len(data)+len(codec.SPS())+len(codec.PPS())+16)
+	if params {
+		out = append(out, startCode...)
+		out = append(out, codec.SPS()...)
+		out = append(out, startCode...)
+		out = append(out, codec.PPS()...)
+	}
+	for len(data) >= 4 {
+		n := int(binary.BigEndian.Uint32(data))
+		data = data[4:]
+		if n > len(data) {
+			break
+		}
+		out = append(out, startCode...)
+		out = append(out, data[:n]...)
+		data = data[n:]
+	}
+	return out
+}
+
+// h264 nal unit types we care about. see table 7-1 of the h.264 spec and
+// section 5.2 of rfc 6184.
+const (
+	naluIDR  = 5
+	naluSPS  = 7
+	naluPPS  = 8
+	naluAUD  = 9
+	naluSTAP = 24
+	naluFU   = 28
+)
+
+// h264Depacketizer puts h.264 access units back together from rtp
+// packets, as described in rfc 6184. It handles single nal unit packets,
+// STAP-A and FU-A, which is all cameras send in practice.
+type h264Depacketizer struct {
+	sps, pps []byte
+
+	nalus  [][]byte // access unit so far
+	fu     []byte   // fragmented nal unit so far
+	ts     uint32
+	seq    uint16
+	synced bool // seen a packet yet
+	broken bool // dropping until the next keyframe
+}
+
+// push adds a packet, calling emit with each access unit it completes.
+func (d *h264Depacketizer) push(p *rtp.Packet, emit func(au [][]byte, ts uint32)) {
+	if d.synced && p.SequenceNumber != d.seq+1 {
+		// lost something. whatever we have is no good, and neither is
+		// anything that refers to it.
+		d.nalus, d.fu = nil, nil
+		d.broken = true
+	}
+	d.synced = true
+	d.seq = p.SequenceNumber
+
+	if len(d.nalus) > 0 && p.Timestamp != d.ts {
+		// new access unit without a marker bit on the last one.
+		d.flush(emit)
+	}
+	d.ts = p.Timestamp
+
+	b := p.Payload
+	if len(b) < 1 {
+		return
+	}
+	switch typ := b[0] & 0x1f; {
+	case typ >= 1 && typ <= 23:
+		d.add(b)
+	case typ == naluSTAP:
+		b = b[1:]
+		for len(b) >= 2 {
+			n := int(binary.BigEndian.Uint16(b))
+			b = b[2:]
+			if n > len(b) {
+				break
+			}
+			if n > 0 {
+				d.add(b[:n])
+			}
+			b = b[n:]
+		}
+	case typ == naluFU:
+		if len(b) < 2 {
+			return
+		}
+		start, end := b[1]&0x80 != 0, b[1]&0x40 != 0
+		if start {
+			d.fu = append(d.fu[:0], b[0]&0xe0|b[1]&0x1f)
+		} else if len(d.fu) == 0 {
+			// missed the start.
+			return
+		}
+		d.fu = append(d.fu, b[2:]...)
+		if end {
+			d.add(d.fu)
+			d.fu = nil
+		}
+	}
+
+	if p.Marker {
+		d.flush(emit)
+	}
+}
+
+func (d *h264Depacketizer) add(nalu []byte) {
+	if len(nalu) == 0 {
+		return
+	}
+	switch nalu[0] & 0x1f {
+	case naluSPS:
+		d.sps = append(d.sps[:0], nalu...)
+		return
+	case naluPPS:
+		d.pps = append(d.pps[:0], nalu...)
+		return
+	case naluAUD:
+		return
+	}
+	d.nalus = append(d.nalus, append([]byte(nil), nalu...))
+}
+
+func (d *h264Depacketizer) flush(emit func(au [][]byte, ts uint32)) {
+	au := d.nalus
+	d.nalus, d.fu = nil, nil
+	if len(au) == 0 {
+		return
+	}
+	if d.broken {
+		if !isKeyframe(au) {
+			return
+		}
+		d.broken = false
+	}
+	emit(au, d.ts)
+}
+
+func isKeyframe(au [][]byte) bool {
+	for _, nalu := range au {
+		if nalu[0]&0x1f == naluIDR {
+			return true
+		}
+	}
+	return false
+}
+
+// annexB joins an access unit's nal units into annex b, with sps and pps
+// up front.
+func annexB(au [][]byte, sps, pps []byte) []byte {
+	n := len(sps) + len(pps) + 8
+	for _, nalu := range au {
+		n += len(nalu) + 4
+	}
+	out := make([]byte, 0, n)
+	out = append(out, startCode...)
+	out = append(out, sps...)
+	out = append(out, startCode...)
+	out = append(out, pps...)
+	for _, nalu := range au {
+		out = append(out, startCode...)
+		out = append(out, nalu...)
+	}
+	return out
+}
+
+// spropParameterSets decodes the sps and pps from an sdp fmtp line, see
+// rfc 6184 section 8.1.
+func spropParameterSets(fmtp map[string]string) (sps, pps []byte) {
+	for _, s := range strings.Split(fmtp["sprop-parameter-sets"], ",") {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			continue
+		}
+		switch b[0] & 0x1f {
+		case naluSPS:
+			sps = b
+		case naluPPS:
+			pps = b
+		}
+	}
+	return sps, pps
+}
+
+// splitAnnexB returns the nal units in an annex b byte stream.
+func splitAnnexB(b []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	for i := 0; i+2 < len(b); i++ {
+		if b[i] != 0 || b[i+1] != 0 || b[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			nalus = appendNALU(nalus, b[start:i])
+		}
+		i += 2
+		start = i + 1
+	}
+	if start >= 0 && start < len(b) {
+		nalus = appendNALU(nalus, b[start:])
+	}
+	return nalus
+}
+
+func appendNALU(nalus [][]byte, nalu []byte) [][]byte {
+	// zeros before a start code are padding, or the first byte of a four
+	// byte one.
+	for len(nalu) > 0 && nalu[len(nalu)-1] == 0 {
+		nalu = nalu[:len(nalu)-1]
+	}
+	if len(nalu) == 0 {
+		return nalus
+	}
+	return append(nalus, nalu)
+}
+
+// accessUnits groups nal units into access units, by the rules in
+// section 7.4.1.2.3 of the h.264 spec that don't need slice headers
+// parsed past first_mb_in_slice.
+func accessUnits(nalus [][]byte) [][][]byte {
+	var aus [][][]byte
+	var au [][]byte
+	vcl := false
+	for _, nalu := range nalus {
+		typ := nalu[0] & 0x1f
+		first := false
+		switch {
+		case typ == 1 || typ == naluIDR:
+			// first_mb_in_slice is zero, whose exp-golomb code is a
+			// single 1 bit.
+			first = len(nalu) > 1 && nalu[1]&0x80 != 0
+		case typ == 6 || typ == naluSPS || typ == naluPPS || typ == naluAUD || (typ >= 14 && typ <= 18):
+			first = true
+		}
+		if first && vcl {
+			aus = append(aus, au)
+			au, vcl = nil, false
+		}
+		au = append(au, nalu)
+		if typ == 1 || typ == naluIDR {
+			vcl = true
+		}
+	}
+	if len(au) > 0 {
+		aus = append(aus, au)
+	}
+	return aus
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0x1f, 0xda}
+	testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+	testIDR = []byte{0x65, 0x88, 0x84, 0x00, 0x33, 0xff}
+	testP   = []byte{0x41, 0x9a, 0x02, 0x03}
+)
+
+type depacketized struct {
+	au [][]byte
+	ts uint32
+}
+
+// depacketize pushes packets with consecutive sequence numbers, skipping
+// any in lost, and returns the access units that come out.
+func depacketize(d *h264Depacketizer, packets []rtp.Packet, lost ...int) []depacketized {
+	var out []depacketized
+	emit := func(au [][]byte, ts uint32) {
+		out = append(out, depacketized{au, ts})
+	}
+	for i := range packets {
+		skip := false
+		for _, l := range lost {
+			skip = skip || l == i
+		}
+		if skip {
+			continue
+		}
+		p := packets[i]
+		p.SequenceNumber = uint16(1000 + i)
+		d.push(&p, emit)
+	}
+	return out
+}
+
+func packet(ts uint32, marker bool, payload ...byte) rtp.Packet {
+	return rtp.Packet{Header: rtp.Header{Timestamp: ts, Marker: marker}, Payload: payload}
+}
+
+func stap(nalus ...[]byte) []byte {
+	b := []byte{0x18}
+	for _, n := range nalus {
+		b = append(b, byte(len(n)>>8), byte(len(n)))
+		b = append(b, n...)
+	}
+	return b
+}
+
+// fu splits nalu into fu-a fragments of at most n bytes of payload.
+func fu(nalu []byte, n int) [][]byte {
+	var frags [][]byte
+	indicator := nalu[0]&0xe0 | naluFU
+	rest := nalu[1:]
+	for first := true; len(rest) > 0; first = false {
+		k := n
+		if k > len(rest) {
+			k = len(rest)
+		}
+		header := nalu[0] & 0x1f
+		if first {
+			header |= 0x80
+		}
+		if k == len(rest) {
+			header |= 0x40
+		}
+		frags = append(frags, append([]byte{indicator, header}, rest[:k]...))
+		rest = rest[k:]
+	}
+	return frags
+}
+
+func TestDepacketizeSingleAndSTAP(t *testing.T) {
+	d := &h264Depacketizer{}
+	got := depacketize(d, []rtp.Packet{
+		packet(3000, false, stap(testSPS, testPPS, []byte{0x09, 0xf0})...),
+		packet(3000, true, testIDR...),
+		packet(6000, true, testP...),
+	})
+	want := []depacketized{
+		{[][]byte{testIDR}, 3000},
+		{[][]byte{testP}, 6000},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+	if !reflect.DeepEqual(d.sps, testSPS) || !reflect.DeepEqual(d.pps, testPPS) {
+		t.Errorf("parameter sets %x %x, want %x %x", d.sps, d.pps, testSPS, testPPS)
+	}
+}
+
+func TestDepacketizeEmptySTAPUnit(t *testing.T) {
+	got := depacketize(&h264Depacketizer{}, []rtp.Packet{
+		packet(3000, true, stap(testSPS, nil, testPPS, testIDR)...),
+		packet(6000, true, stap(nil)...),
+	})
+	want := []depacketized{{[][]byte{testIDR}, 3000}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+}
+
+func TestDepacketizeFU(t *testing.T) {
+	frags := fu(testIDR, 2)
+	if len(frags) != 3 {
+		t.Fatalf("%d fragments, want 3", len(frags))
+	}
+	got := depacketize(&h264Depacketizer{}, []rtp.Packet{
+		packet(3000, false, frags[0]...),
+		packet(3000, false, frags[1]...),
+		packet(3000, true, frags[2]...),
+	})
+	want := []depacketized{{[][]byte{testIDR}, 3000}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+}
+
+func TestDepacketizeMissingMarker(t *testing.T) {
+	// a new timestamp ends the access unit before it.
+	got := depacketize(&h264Depacketizer{}, []rtp.Packet{
+		packet(3000, false, testIDR...),
+		packet(6000, false, testP...),
+		packet(9000, true, testP...),
+	})
+	want := []depacketized{
+		{[][]byte{testIDR}, 3000},
+		{[][]byte{testP}, 6000},
+		{[][]byte{testP}, 9000},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+}
+
+func TestDepacketizeLoss(t *testing.T) {
+	frags := fu(testP, 2)
+	got := depacketize(&h264Depacketizer{}, []rtp.Packet{
+		packet(3000, true, testIDR...),
+		packet(6000, false, frags[0]...),
+		packet(6000, true, frags[1]...), // lost
+		packet(9000, true, testP...),    // refers to what was lost
+		packet(12000, true, testIDR...),
+		packet(15000, true, testP...),
+	}, 2)
+	want := []depacketized{
+		{[][]byte{testIDR}, 3000},
+		{[][]byte{testIDR}, 12000},
+		{[][]byte{testP}, 15000},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+}
+
+func TestDepacketizeFUWithoutStart(t *testing.T) {
+	frags := fu(testIDR, 2)
+	d := &h264Depacketizer{}
+	got := depacketize(d, []rtp.Packet{
+		packet(3000, false, frags[1]...),
+		packet(3000, true, frags[2]...),
+		packet(6000, true, testIDR...),
+	})
+	want := []depacketized{{[][]byte{testIDR}, 6000}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+}
+
+func TestSplitAnnexB(t *testing.T) {
+	b := annexB([][]byte{testIDR}, testSPS, testPPS)
+	// a three byte start code, and trailing zeros.
+	b = append(b, 0, 0, 1)
+	b = append(b, testP...)
+	b = append(b, 0, 0)
+	got := splitAnnexB(b)
+	want := [][]byte{testSPS, testPPS, testIDR, testP}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+	aus := accessUnits(got)
+	if len(aus) != 2 || len(aus[0]) != 3 || len(aus[1]) != 1 {
+		t.Errorf("access units %x", aus)
+	}
+}
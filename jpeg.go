@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// sources that only do jpegs: an mjpeg stream over http, or a snapshot
+// url we poll. ffmpeg encodes the jpegs as h.264 for viewers and
+// recordings, and sends it back to us as rtp so it comes in frames.
+// motion detection looks at the jpegs themselves rather than decoding the
+// h.264 again.
+
+// source types, besides rtsp, which also covers rtsps and rtmp urls.
+const (
+	sourceMJPEG    = "mjpeg"
+	sourceSnapshot = "snapshot-poll"
+)
+
+var sourceTypes = map[string]bool{
+	"":             true, // rtsp
+	"rtsp":         true,
+	sourceMJPEG:    true,
+	sourceSnapshot: true,
+}
+
+const (
+	defaultSnapshotInterval = time.Second
+	snapshotTimeout         = 10 * time.Second
+	maxJPEGSize             = 16 << 20
+)
+
+func (c *camera) jpegSource() bool {
+	return c.kind == sourceMJPEG || c.kind == sourceSnapshot
+}
+
+// readJPEGs reads the camera's jpegs, and the video ffmpeg makes of them,
+// until something fails or ctx is done.
+func (c *camera) readJPEGs(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	enc, conn, err := startEncoder(ctx)
+	if err != nil {
+		return fmt.Errorf("could not start ffmpeg: %w", err)
+	}
+	defer enc.Close()
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	encErr := make(chan error, 1)
+	go func() {
+		encErr <- c.readEncoded(conn)
+	}()
+
+	var thumbs io.Writer
+	if c.threshold != 0 && c.record != nil {
+		pr, pw := io.Pipe()
+		defer pw.Close()
+		go func() {
+			c.detectMotion(ctx, pr)
+			// so writes don't block once nobody's reading.
+			pr.Close()
+		}()
+		thumbs = pw
+	}
+	thumb := make([]byte, 320*240)
+
+	handle := func(jpg []byte) error {
+		select {
+		case err := <-encErr:
+			return err
+		default:
+		}
+		if _, err := enc.Write(jpg); err != nil {
+			return fmt.Errorf("can not write to ffmpeg: %w", err)
+		}
+		if thumbs == nil {
+			return nil
+		}
+		img, err := jpeg.Decode(bytes.NewReader(jpg))
+		if err != nil {
+			// ffmpeg will have its own opinion on it. the next one will
+			// probably be fine.
+			return nil
+		}
+		motionFrame(img, thumb)
+		thumbs.Write(thumb)
+		return nil
+	}
+
+	if c.kind == sourceMJPEG {
+		return c.readMJPEG(ctx, handle)
+	}
+	return c.pollSnapshots(ctx, handle)
+}
+
+// startEncoder runs ffmpeg to encode the jpegs written to enc as h.264,
+// which comes back as rtp on conn.
+func startEncoder(ctx context.Context) (enc io.WriteCloser, conn *net.UDPConn, err error) {
+	if len(ffmpegCommand) == 0 {
+		return nil, nil, errors.New("ffmpeg disabled")
+	}
+	// only ffmpeg, on this machine, should be sending to it.
+	conn, rtcp, err := listenRTPPair(net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		return nil, nil, err
+	}
+	// ffmpeg sends sender reports, which we don't care about, but
+	// something has to be there to take them.
+	go func() {
+		<-ctx.Done()
+		rtcp.Close()
+	}()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	cmd := exec.CommandContext(ctx, ffmpegCommand[0], append(ffmpegCommand[1:],
+		"-use_wallclock_as_timestamps", "1",
+		"-f", "mjpeg",
+		"-i", "-",
+		"-an",
+		"-vsync", "passthrough",
+		"-vcodec", "libx264",
+		"-preset", "veryfast",
+		"-tune", "zerolatency",
+		"-profile:v", "baseline",
+		"-pix_fmt", "yuv420p",
+		"-force_key_frames", "expr:gte(t,n_forced*2)",
+		// sps and pps in band, since we don't read the sdp.
+		"-x264-params", "repeat-headers=1",
+		"-f", "rtp",
+		fmt.Sprintf("rtp://127.0.0.1:%d?pkt_size=1200", port),
+	)...)
+	enc, err = cmd.StdinPipe()
+	if err == nil && debug {
+		var fferr io.ReadCloser
+		fferr, err = cmd.StderrPipe()
+		if err == nil {
+			go io.Copy(os.Stderr, fferr)
+		}
+	}
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		conn.Close()
+		rtcp.Close()
+		return nil, nil, err
+	}
+	go cmd.Wait()
+	return enc, conn, nil
+}
+
+// readEncoded writes the video ffmpeg sends to conn to the camera.
+func (c *camera) readEncoded(conn *net.UDPConn) error {
+	w := &auWriter{c: c, d: &h264Depacketizer{}}
+	buf := make([]byte, 1<<16)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		var p rtp.Packet
+		if p.Unmarshal(append([]byte(nil), buf[:n]...)) != nil {
+			continue
+		}
+		w.d.push(&p, w.emit)
+		if w.err != nil {
+			return fmt.Errorf("can not write frame: %w", w.err)
+		}
+	}
+}
+
+func (c *camera) readMJPEG(ctx context.Context, handle func([]byte) error) error {
+	resp, err := c.httpGet(ctx, http.DefaultClient)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ct := resp.Header.Get("Content-Type")
+	mediatype, params, err := mime.ParseMediaType(ct)
+	if err != nil || mediatype != "multipart/x-mixed-replace" || params["boundary"] == "" {
+		return fmt.Errorf("%w: %q is not mjpeg", errUnsupportedCodec, ct)
+	}
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return fmt.Errorf("can not read mjpeg: %w", err)
+		}
+		jpg, err := ioutil.ReadAll(io.LimitReader(part, maxJPEGSize))
+		if err != nil {
+			return fmt.Errorf("can not read mjpeg: %w", err)
+		}
+		if err := handle(jpg); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *camera) pollSnapshots(ctx context.Context, handle func([]byte) error) error {
+	client := &http.Client{Timeout: snapshotTimeout}
+	t := time.NewTicker(c.pollInterval)
+	defer t.Stop()
+	for {
+		resp, err := c.httpGet(ctx, client)
+		if err != nil {
+			return err
+		}
+		jpg, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxJPEGSize))
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("can not read snapshot: %w", err)
+		}
+		if err := handle(jpg); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// httpGet fetches the camera's url, with basic or digest auth from its
+// userinfo if the camera asks for it. Responses other than 200 are
+// returned as statusErrors.
+func (c *camera) httpGet(ctx context.Context, client *http.Client) (*http.Response, error) {
+	u, err := url.Parse(c.src)
+	if err != nil {
+		return nil, err
+	}
+	auth := newAuthenticator(u.User)
+	u.User = nil
+	if c.tlsConfig != nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = c.tlsConfig
+		client = &http.Client{Transport: t, Timeout: client.Timeout}
+	}
+	for retried := false; ; retried = true {
+		req, err := http.NewRequest("GET", u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		if a := auth.authorization("GET", u.RequestURI(), nil); a != "" {
+			req.Header.Set("Authorization", a)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && !retried &&
+			auth.challenge(&response{Header: textproto.MIMEHeader(resp.Header)}) {
+			resp.Body.Close()
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, &statusError{Method: "GET", URL: u, StatusCode: resp.StatusCode, Status: resp.Status}
+		}
+		return resp, nil
+	}
+}
+
+// motionFrame scales img down to the 320x240 grey edge map detectMotion
+// works on, which is roughly what ffmpeg's scale and edgedetect filters
+// make for other sources, so thresholds mean about the same thing.
+func motionFrame(img image.Image, out []byte) {
+	const w, h = 320, 240
+	b := img.Bounds()
+	grey := make([]byte, w*h)
+	yc, isYCbCr := img.(*image.YCbCr)
+	for y := 0; y < h; y++ {
+		sy := b.Min.Y + y*b.Dy()/h
+		for x := 0; x < w; x++ {
+			sx := b.Min.X + x*b.Dx()/w
+			if isYCbCr {
+				grey[y*w+x] = yc.Y[yc.YOffset(sx, sy)]
+			} else {
+				grey[y*w+x] = color.GrayModel.Convert(img.At(sx, sy)).(color.Gray).Y
+			}
+		}
+	}
+	for i := range out {
+		out[i] = 0
+	}
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			i := y*w + x
+			gx := int(grey[i+1]) - int(grey[i-1])
+			gy := int(grey[i+w]) - int(grey[i-w])
+			if gx < 0 {
+				gx = -gx
+			}
+			if gy < 0 {
+				gy = -gy
+			}
+			if gx+gy > 48 {
+				out[i] = 255
+			}
+		}
+	}
+}
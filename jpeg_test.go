@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// frameCounter counts the frames written to a camera's recording.
+type frameCounter struct {
+	sync.Mutex
+	n int
+}
+
+func (fc *frameCounter) Write(b []byte) (int, error) {
+	fc.Lock()
+	fc.n++
+	fc.Unlock()
+	return len(b), nil
+}
+
+func (fc *frameCounter) frames() int {
+	fc.Lock()
+	defer fc.Unlock()
+	return fc.n
+}
+
+func TestEncoderListensOnLoopback(t *testing.T) {
+	defer func(cmd []string) { ffmpegCommand = cmd }(ffmpegCommand)
+	ffmpegCommand = []string{"sh", "-c", "cat >/dev/null", "ffmpeg"}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	enc, conn, err := startEncoder(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+	defer conn.Close()
+	if addr := conn.LocalAddr().(*net.UDPAddr); !addr.IP.IsLoopback() {
+		t.Errorf("encoder listens on %v, want loopback", addr)
+	}
+}
+
+func TestReadEncoded(t *testing.T) {
+	conn, rtcp, err := listenRTPPair(net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rtcp.Close()
+	fc := &frameCounter{}
+	c := &camera{id: "cam", ffin: ioutil.Discard, record: fc}
+	done := make(chan error, 1)
+	go func() { done <- c.readEncoded(conn) }()
+
+	ffmpeg, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ffmpeg.Close()
+	for _, p := range []rtp.Packet{
+		{Header: rtp.Header{Version: 2, SequenceNumber: 0}, Payload: stap(testSPS, testPPS)},
+		{Header: rtp.Header{Version: 2, SequenceNumber: 1, Marker: true}, Payload: testIDR},
+		{Header: rtp.Header{Version: 2, SequenceNumber: 2, Timestamp: 3000, Marker: true}, Payload: testP},
+	} {
+		buf, err := p.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ffmpeg.Write(buf)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for fc.frames() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := fc.frames(); n != 2 {
+		t.Errorf("%d frames, want 2", n)
+	}
+
+	conn.Close()
+	<-done
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// just enough onvif to find cameras, their streams, and to move them
+// around. onvif is soap, so calls are templated xml in and
+// encoding/xml out. elements are matched by local name, since every
+// vendor prefixes them differently.
+
+const (
+	soapEnvelopeNS = "http://www.w3.org/2003/05/soap-envelope"
+	onvifTimeout   = 10 * time.Second
+)
+
+var onvifClient = &http.Client{Timeout: onvifTimeout}
+
+// onvifFault is a soap fault.
+type onvifFault struct {
+	Code   string `xml:"Code>Value"`
+	Reason string `xml:"Reason>Text"`
+}
+
+func (f *onvifFault) Error() string {
+	return fmt.Sprintf("onvif fault %s: %s", f.Code, strings.TrimSpace(f.Reason))
+}
+
+// onvifCall sends body, an element from one of the onvif wsdls, to the
+// service at xaddr and decodes the soap body of the response into resp.
+// Credentials from xaddr's userinfo go in a ws-security header, and in
+// http auth if the camera asks for it.
+func onvifCall(ctx context.Context, xaddr string, body string, resp interface{}) error {
+	return onvifCallHeader(ctx, xaddr, "", body, resp)
+}
+
+// onvifCallHeader is onvifCall with extra soap header elements.
+func onvifCallHeader(ctx context.Context, xaddr, header, body string, resp interface{}) error {
+	u, err := url.Parse(xaddr)
+	if err != nil {
+		return err
+	}
+	user := u.User
+	u.User = nil
+
+	var envelope bytes.Buffer
+	fmt.Fprintf(&envelope, `<?xml version="1.0" encoding="UTF-8"?>`+
+		`<s:Envelope xmlns:s="%s"><s:Header>%s</s:Header><s:Body>%s</s:Body></s:Envelope>`,
+		soapEnvelopeNS, wsSecurity(user)+header, body)
+
+	auth := newAuthenticator(user)
+	var hresp *http.Response
+	for retried := false; ; retried = true {
+		req, err := http.NewRequest("POST", u.String(), bytes.NewReader(envelope.Bytes()))
+		if err != nil {
+			return err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/soap+xml; charset=utf-8")
+		if a := auth.authorization("POST", u.RequestURI(), envelope.Bytes()); a != "" {
+			req.Header.Set("Authorization", a)
+		}
+		hresp, err = onvifClient.Do(req)
+		if err != nil {
+			return err
+		}
+		if hresp.StatusCode == http.StatusUnauthorized && !retried &&
+			auth.challenge(&response{Header: textproto.MIMEHeader(hresp.Header)}) {
+			hresp.Body.Close()
+			continue
+		}
+		break
+	}
+	defer hresp.Body.Close()
+
+	buf, err := ioutil.ReadAll(hresp.Body)
+	if err != nil {
+		return err
+	}
+	var env struct {
+		Body struct {
+			Fault *onvifFault
+			Inner []byte `xml:",innerxml"`
+		}
+	}
+	err = xml.Unmarshal(buf, &env)
+	if err != nil {
+		return fmt.Errorf("%s: %s", u.Redacted(), hresp.Status)
+	}
+	if env.Body.Fault != nil {
+		return env.Body.Fault
+	}
+	if hresp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", u.Redacted(), hresp.Status)
+	}
+	if resp == nil {
+		return nil
+	}
+	// decode the element inside the body, whatever it's called.
+	return xml.Unmarshal(bytes.TrimSpace(env.Body.Inner), resp)
+}
+
+// wsSecurity returns a ws-security UsernameToken header with a password
+// digest, as described in the onvif core spec section 5.12.
+func wsSecurity(user *url.Userinfo) string {
+	if user == nil {
+		return ""
+	}
+	password, _ := user.Password()
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	created := time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+	h := sha1.New()
+	h.Write(nonce[:])
+	h.Write([]byte(created))
+	h.Write([]byte(password))
+	digest := base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+	var b strings.Builder
+	b.WriteString(`<Security s:mustUnderstand="1" xmlns="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd">`)
+	b.WriteString(`<UsernameToken><Username>`)
+	xml.EscapeText(&b, []byte(user.Username()))
+	b.WriteString(`</Username>`)
+	b.WriteString(`<Password Type="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-username-token-profile-1.0#PasswordDigest">`)
+	b.WriteString(digest)
+	b.WriteString(`</Password>`)
+	b.WriteString(`<Nonce EncodingType="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-soap-message-security-1.0#Base64Binary">`)
+	b.WriteString(base64.StdEncoding.EncodeToString(nonce[:]))
+	b.WriteString(`</Nonce>`)
+	b.WriteString(`<Created xmlns="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd">`)
+	b.WriteString(created)
+	b.WriteString(`</Created></UsernameToken></Security>`)
+	return b.String()
+}
+
+// onvifService finds the address of one of a device's services, e.g.
+// "media" or "ptz", from the device service at xaddr. The address comes
+// back with xaddr's credentials.
+func onvifService(ctx context.Context, xaddr, category string) (string, error) {
+	var resp struct {
+		Media struct {
+			XAddr string
+		} `xml:"Capabilities>Media"`
+		PTZ struct {
+			XAddr string
+		} `xml:"Capabilities>PTZ"`
+		Events struct {
+			XAddr string
+		} `xml:"Capabilities>Events"`
+	}
+	err := onvifCall(ctx, xaddr,
+		`<GetCapabilities xmlns="http://www.onvif.org/ver10/device/wsdl"><Category>All</Category></GetCapabilities>`,
+		&resp)
+	if err != nil {
+		return "", err
+	}
+	var addr string
+	switch category {
+	case "media":
+		addr = resp.Media.XAddr
+	case "ptz":
+		addr = resp.PTZ.XAddr
+	case "events":
+		addr = resp.Events.XAddr
+	}
+	if addr == "" {
+		return "", fmt.Errorf("device has no %s service", category)
+	}
+	return withUserinfo(addr, xaddr)
+}
+
+// withUserinfo returns addr with the userinfo from from.
+func withUserinfo(addr, from string) (string, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", err
+	}
+	f, err := url.Parse(from)
+	if err != nil {
+		return "", err
+	}
+	u.User = f.User
+	return u.String(), nil
+}
+
+// onvifProfile is a media profile, i.e. a stream the camera offers.
+type onvifProfile struct {
+	Token  string `xml:"token,attr"`
+	Name   string
+	Width  int    `xml:"VideoEncoderConfiguration>Resolution>Width"`
+	Height int    `xml:"VideoEncoderConfiguration>Resolution>Height"`
+	Codec  string `xml:"VideoEncoderConfiguration>Encoding"`
+}
+
+func onvifProfiles(ctx context.Context, media string) ([]onvifProfile, error) {
+	var resp struct {
+		Profiles []onvifProfile
+	}
+	err := onvifCall(ctx, media, `<GetProfiles xmlns="http://www.onvif.org/ver10/media/wsdl"/>`, &resp)
+	return resp.Profiles, err
+}
+
+func onvifStreamURI(ctx context.Context, media, profile string) (string, error) {
+	var resp struct {
+		URI string `xml:"MediaUri>Uri"`
+	}
+	err := onvifCall(ctx, media, `<GetStreamUri xmlns="http://www.onvif.org/ver10/media/wsdl">`+
+		`<StreamSetup><Stream xmlns="http://www.onvif.org/ver10/schema">RTP-Unicast</Stream>`+
+		`<Transport xmlns="http://www.onvif.org/ver10/schema"><Protocol>RTSP</Protocol></Transport></StreamSetup>`+
+		`<ProfileToken>`+xmlEscape(profile)+`</ProfileToken></GetStreamUri>`, &resp)
+	if err != nil {
+		return "", err
+	}
+	if resp.URI == "" {
+		return "", fmt.Errorf("no stream uri for profile %s", profile)
+	}
+	return resp.URI, nil
+}
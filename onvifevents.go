@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// motion detected by the camera itself, from the onvif events service.
+// we make a pull point subscription and poll it, see the onvif event
+// service spec section 9.
+
+const (
+	eventsNS = "http://www.onvif.org/ver10/events/wsdl"
+	wsnNS    = "http://docs.oasis-open.org/wsn/b-2"
+	wsaNS    = "http://www.w3.org/2005/08/addressing"
+
+	// how long a subscription lasts unless it's renewed.
+	subscriptionTerm = time.Minute
+
+	// how long the camera may hold a pull open waiting for something to
+	// happen. has to be well under onvifTimeout.
+	pullTimeout = 5 * time.Second
+)
+
+// how often we renew subscriptions. a var so tests needn't wait.
+var subscriptionRenew = 30 * time.Second
+
+// pullPoint is a subscription to a camera's events.
+type pullPoint struct {
+	to     string // address, as the camera gave it
+	addr   string // with credentials
+	params string // reference parameters, which go back as headers
+}
+
+// onvifNotification is one event from a pull.
+type onvifNotification struct {
+	Topic  string
+	Source []simpleItem `xml:"Message>Message>Source>SimpleItem"`
+	Data   []simpleItem `xml:"Message>Message>Data>SimpleItem"`
+}
+
+type simpleItem struct {
+	Name  string `xml:",attr"`
+	Value string `xml:",attr"`
+}
+
+// motion works out whether n says something started or stopped moving.
+// line crossings and the like are one-offs rather than states, so they're
+// a pulse. ok is false for events that aren't about motion.
+func (n onvifNotification) motion() (moving, pulse, ok bool) {
+	topic := strings.ToLower(n.Topic)
+	if !strings.Contains(topic, "motion") &&
+		!strings.Contains(topic, "linedetector") &&
+		!strings.Contains(topic, "fielddetector") {
+		return false, false, false
+	}
+	for _, it := range n.Data {
+		switch it.Name {
+		case "IsMotion", "State", "IsInside":
+			return it.Value == "true" || it.Value == "1", false, true
+		}
+	}
+	return true, true, true
+}
+
+// key tells apart the things that can be moving at once, e.g. two
+// detection rules or two video sources.
+func (n onvifNotification) key() string {
+	k := strings.TrimSpace(n.Topic)
+	for _, it := range n.Source {
+		k += " " + it.Name + "=" + it.Value
+	}
+	return k
+}
+
+func xsDuration(d time.Duration) string {
+	return fmt.Sprintf("PT%dS", int(d.Seconds()))
+}
+
+func subscribeEvents(ctx context.Context, xaddr string) (*pullPoint, error) {
+	var resp struct {
+		Address string `xml:"SubscriptionReference>Address"`
+		Params  struct {
+			Inner string `xml:",innerxml"`
+		} `xml:"SubscriptionReference>ReferenceParameters"`
+	}
+	err := onvifCall(ctx, xaddr, `<CreatePullPointSubscription xmlns="`+eventsNS+`">`+
+		`<InitialTerminationTime>`+xsDuration(subscriptionTerm)+`</InitialTerminationTime>`+
+		`</CreatePullPointSubscription>`, &resp)
+	if err != nil {
+		return nil, err
+	}
+	to := strings.TrimSpace(resp.Address)
+	if to == "" {
+		return nil, fmt.Errorf("no subscription address")
+	}
+	addr, err := withUserinfo(to, xaddr)
+	if err != nil {
+		return nil, err
+	}
+	return &pullPoint{to: to, addr: addr, params: resp.Params.Inner}, nil
+}
+
+// call sends body to the subscription, addressed so that cameras which
+// put many subscriptions behind one url can tell which it's for.
+func (p *pullPoint) call(ctx context.Context, action, body string, resp interface{}) error {
+	header := `<Action xmlns="` + wsaNS + `">` + action + `</Action>` +
+		`<To xmlns="` + wsaNS + `">` + xmlEscape(p.to) + `</To>` + p.params
+	return onvifCallHeader(ctx, p.addr, header, body, resp)
+}
+
+func (p *pullPoint) pull(ctx context.Context) ([]onvifNotification, error) {
+	var resp struct {
+		Messages []onvifNotification `xml:"NotificationMessage"`
+	}
+	err := p.call(ctx, eventsNS+"/PullPointSubscription/PullMessagesRequest",
+		`<PullMessages xmlns="`+eventsNS+`"><Timeout>`+xsDuration(pullTimeout)+`</Timeout>`+
+			`<MessageLimit>32</MessageLimit></PullMessages>`, &resp)
+	return resp.Messages, err
+}
+
+func (p *pullPoint) renew(ctx context.Context) error {
+	return p.call(ctx, "http://docs.oasis-open.org/wsn/bw-2/SubscriptionManager/RenewRequest",
+		`<Renew xmlns="`+wsnNS+`"><TerminationTime>`+xsDuration(subscriptionTerm)+`</TerminationTime></Renew>`, nil)
+}
+
+func (p *pullPoint) unsubscribe(ctx context.Context) error {
+	return p.call(ctx, "http://docs.oasis-open.org/wsn/bw-2/SubscriptionManager/UnsubscribeRequest",
+		`<Unsubscribe xmlns="`+wsnNS+`"/>`, nil)
+}
+
+// watchEvents starts recordings when the camera says it sees motion,
+// until ctx is done.
+func (c *camera) watchEvents(ctx context.Context) {
+	failures := 0
+	for {
+		pulled, err := c.pullEvents(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if pulled {
+			failures = 0
+		}
+		d := backoff(failures)
+		failures++
+		log.Printf("%s: onvif events: %v, retrying in %v", c.id, err, d.Round(time.Second))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(d):
+		}
+	}
+}
+
+// pullEvents subscribes to the camera's events and acts on them until
+// something goes wrong. pulled says whether any pulls worked.
+func (c *camera) pullEvents(ctx context.Context) (pulled bool, err error) {
+	xaddr, err := onvifService(ctx, c.onvif, "events")
+	if err != nil {
+		return false, err
+	}
+	p, err := subscribeEvents(ctx, xaddr)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), onvifTimeout)
+		defer cancel()
+		p.unsubscribe(ctx)
+	}()
+
+	// we can't see motion we aren't told about.
+	defer c.setCameraMotion(false)
+
+	active := map[string]bool{}
+	renewed := time.Now()
+	for {
+		if time.Since(renewed) > subscriptionRenew {
+			err = p.renew(ctx)
+			if err != nil {
+				return pulled, err
+			}
+			renewed = time.Now()
+		}
+		start := time.Now()
+		msgs, err := p.pull(ctx)
+		if err != nil {
+			return pulled, err
+		}
+		pulled = true
+		for _, n := range msgs {
+			moving, pulse, ok := n.motion()
+			if !ok {
+				continue
+			}
+			if !pulse {
+				if moving {
+					active[n.key()] = true
+				} else {
+					delete(active, n.key())
+				}
+				c.setCameraMotion(len(active) > 0)
+			}
+			if moving {
+				c.recordMotion(ctx)
+			}
+		}
+		if len(active) > 0 {
+			// still moving, though the camera only says so when it
+			// starts. keep recording.
+			c.recordMotion(ctx)
+		}
+		if len(msgs) == 0 && time.Since(start) < time.Second {
+			// the camera doesn't wait for events, so don't spin.
+			select {
+			case <-ctx.Done():
+				return pulled, ctx.Err()
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+// setCameraMotion records whether the camera's own detection sees
+// anything moving, and tells viewers when that changes.
+func (c *camera) setCameraMotion(moving bool) {
+	c.Lock()
+	changed := c.cameraMotion != moving
+	c.cameraMotion = moving
+	c.Unlock()
+	if changed {
+		c.emit("motion", motionEvent{Moving: moving})
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func motionNotification(moving bool) string {
+	v := "false"
+	if moving {
+		v = "true"
+	}
+	return `<wsnt:NotificationMessage><wsnt:Topic Dialect="http://www.onvif.org/ver10/tev/topicExpression/ConcreteSet">` +
+		`tns1:RuleEngine/CellMotionDetector/Motion</wsnt:Topic><wsnt:Message><tt:Message UtcTime="2021-05-01T12:00:00Z">` +
+		`<tt:Source><tt:SimpleItem Name="VideoSourceConfigurationToken" Value="VideoSourceToken"/></tt:Source>` +
+		`<tt:Data><tt:SimpleItem Name="IsMotion" Value="` + v + `"/></tt:Data>` +
+		`</tt:Message></wsnt:Message></wsnt:NotificationMessage>`
+}
+
+// fakePullPoint is an onvif device with an events service that hands out
+// one pull point subscription.
+type fakePullPoint struct {
+	*httptest.Server
+	c *camera
+
+	sync.Mutex
+	actions []string
+	motion  []bool // the camera's motion state at each pull
+	renews  []string
+}
+
+func newFakePullPoint(t *testing.T, c *camera) *fakePullPoint {
+	f := &fakePullPoint{c: c}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakePullPoint) serve(w http.ResponseWriter, r *http.Request) {
+	b, _ := ioutil.ReadAll(r.Body)
+	body := string(b)
+	action := func(name string) bool {
+		if !strings.Contains(body, "<"+name+" ") && !strings.Contains(body, "<"+name+">") {
+			return false
+		}
+		f.Lock()
+		f.actions = append(f.actions, name)
+		f.Unlock()
+		return true
+	}
+	subscription := r.URL.Path == "/onvif/subscription/1" &&
+		strings.Contains(body, `<To xmlns="`+wsaNS+`">`+f.URL+`/onvif/subscription/1</To>`) &&
+		strings.Contains(body, `<tev:SubscriptionId xmlns:tev="`+eventsNS+`">1</tev:SubscriptionId>`)
+	switch {
+	case r.URL.Path == "/onvif/device_service" && action("GetCapabilities"):
+		soapResponse(w, `<tds:GetCapabilitiesResponse><tds:Capabilities>`+
+			`<tt:Events><tt:XAddr>`+f.URL+`/onvif/events</tt:XAddr></tt:Events>`+
+			`</tds:Capabilities></tds:GetCapabilitiesResponse>`)
+	case r.URL.Path == "/onvif/events" && action("CreatePullPointSubscription"):
+		soapResponse(w, `<tev:CreatePullPointSubscriptionResponse xmlns:tev="`+eventsNS+`" `+
+			`xmlns:wsa="`+wsaNS+`"><tev:SubscriptionReference>`+
+			`<wsa:Address>`+f.URL+`/onvif/subscription/1</wsa:Address>`+
+			`<wsa:ReferenceParameters><tev:SubscriptionId xmlns:tev="`+eventsNS+`">1</tev:SubscriptionId></wsa:ReferenceParameters>`+
+			`</tev:SubscriptionReference></tev:CreatePullPointSubscriptionResponse>`)
+	case subscription && action("PullMessages"):
+		f.c.RLock()
+		moving := f.c.cameraMotion
+		f.c.RUnlock()
+		f.Lock()
+		f.motion = append(f.motion, moving)
+		n := len(f.motion)
+		f.Unlock()
+		var msgs string
+		switch n {
+		case 1:
+			msgs = motionNotification(true)
+		case 2:
+			msgs = motionNotification(false)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			soapResponse(w, `<env:Fault><env:Code><env:Value>env:Receiver</env:Value></env:Code>`+
+				`<env:Reason><env:Text>subscription gone</env:Text></env:Reason></env:Fault>`)
+			return
+		}
+		soapResponse(w, `<tev:PullMessagesResponse xmlns:tev="`+eventsNS+`" xmlns:wsnt="`+wsnNS+`" `+
+			`xmlns:tns1="http://www.onvif.org/ver10/topics">`+
+			`<tev:CurrentTime>2021-05-01T12:00:00Z</tev:CurrentTime>`+
+			`<tev:TerminationTime>2021-05-01T12:01:00Z</tev:TerminationTime>`+
+			msgs+`</tev:PullMessagesResponse>`)
+	case subscription && action("Renew"):
+		f.Lock()
+		f.renews = append(f.renews, body)
+		f.Unlock()
+		soapResponse(w, `<wsnt:RenewResponse xmlns:wsnt="`+wsnNS+`">`+
+			`<wsnt:TerminationTime>2021-05-01T12:01:00Z</wsnt:TerminationTime></wsnt:RenewResponse>`)
+	case subscription && action("Unsubscribe"):
+		soapResponse(w, `<wsnt:UnsubscribeResponse xmlns:wsnt="`+wsnNS+`"/>`)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestPullEvents(t *testing.T) {
+	// renew before every pull.
+	defer func(d time.Duration) { subscriptionRenew = d }(subscriptionRenew)
+	subscriptionRenew = 0
+
+	c := &camera{id: "cam"}
+	f := newFakePullPoint(t, c)
+	c.onvif = f.URL + "/onvif/device_service"
+
+	pulled, err := c.pullEvents(context.Background())
+	if !pulled {
+		t.Error("pulled is false")
+	}
+	if err == nil || !strings.Contains(err.Error(), "subscription gone") {
+		t.Errorf("err = %v, want the fault", err)
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	want := []string{
+		"GetCapabilities", "CreatePullPointSubscription",
+		"Renew", "PullMessages",
+		"Renew", "PullMessages",
+		"Renew", "PullMessages",
+		"Unsubscribe",
+	}
+	if !reflect.DeepEqual(f.actions, want) {
+		t.Errorf("actions = %q, want %q", f.actions, want)
+	}
+	if want := []bool{false, true, false}; !reflect.DeepEqual(f.motion, want) {
+		t.Errorf("motion at each pull = %v, want %v", f.motion, want)
+	}
+	for _, r := range f.renews {
+		if !strings.Contains(r, "<TerminationTime>PT60S</TerminationTime>") {
+			t.Errorf("renew without a termination time: %s", r)
+		}
+	}
+	if c.cameraMotion {
+		t.Error("camera still moving after the subscription went away")
+	}
+}
+
+func TestNotificationMotion(t *testing.T) {
+	for _, tt := range []struct {
+		topic             string
+		data              []simpleItem
+		moving, pulse, ok bool
+	}{
+		{"tns1:RuleEngine/CellMotionDetector/Motion", []simpleItem{{"IsMotion", "true"}}, true, false, true},
+		{"tns1:RuleEngine/CellMotionDetector/Motion", []simpleItem{{"IsMotion", "false"}}, false, false, true},
+		{"tns1:VideoSource/MotionAlarm", []simpleItem{{"State", "1"}}, true, false, true},
+		{"tns1:RuleEngine/FieldDetector/ObjectsInside", []simpleItem{{"IsInside", "0"}}, false, false, true},
+		{"tns1:RuleEngine/LineDetector/Crossed", []simpleItem{{"ObjectId", "3"}}, true, true, true},
+		{"tns1:Device/Trigger/DigitalInput", []simpleItem{{"LogicalState", "true"}}, false, false, false},
+	} {
+		n := onvifNotification{Topic: tt.topic, Data: tt.data}
+		moving, pulse, ok := n.motion()
+		if moving != tt.moving || pulse != tt.pulse || ok != tt.ok {
+			t.Errorf("%s %v: motion() = %v, %v, %v, want %v, %v, %v",
+				tt.topic, tt.data, moving, pulse, ok, tt.moving, tt.pulse, tt.ok)
+		}
+	}
+}
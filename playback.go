@@ -0,0 +1,640 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/format/mp4"
+	"github.com/deepch/vdk/format/mp4/mp4io"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// playback of recordings over webrtc. the browser drives the player
+// over its data channel with the same versioned messages as the live
+// view, see commands.go. the commands are "play", "pause", "seek", with
+// {"Position": seconds}, and "speed", with {"Speed": 2}. we send a
+// "status" with a playerStatus every second.
+
+type recording struct {
+	Name   string // relative to outDir, e.g. 2021-06-01/150405-cam1.mp4
+	Camera string
+	Time   time.Time
+}
+
+// parseRecordingName checks that name is something newRecordingFilename
+// could have made, so that it's safe to open.
+func parseRecordingName(name string) (recording, error) {
+	day, file, ok := strings.Cut(name, "/")
+	ext := filepath.Ext(file)
+	if !ok || (ext != ".mp4" && ext != ".jpg") {
+		return recording{}, fmt.Errorf("bad recording name %q", name)
+	}
+	clock, id, ok := strings.Cut(strings.TrimSuffix(file, ext), "-")
+	if !ok || id == "" || strings.ContainsAny(id, `/\`) {
+		return recording{}, fmt.Errorf("bad recording name %q", name)
+	}
+	t, err := time.ParseInLocation("2006-01-02 150405", day+" "+clock, time.Local)
+	if err != nil {
+		return recording{}, fmt.Errorf("bad recording name %q", name)
+	}
+	return recording{Name: name, Camera: id, Time: t}, nil
+}
+
+// readRecordings returns all the mp4 recordings in outDir, in no
+// particular order.
+func readRecordings() ([]recording, error) {
+	names, err := filepath.Glob(filepath.Join(outDir, "*", "*.mp4"))
+	if err != nil {
+		return nil, err
+	}
+	var recs []recording
+	for _, n := range names {
+		rel, err := filepath.Rel(outDir, n)
+		if err != nil {
+			continue
+		}
+		rec, err := parseRecordingName(filepath.ToSlash(rel))
+		if err != nil {
+			continue
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+// listRecordings returns the recordings the remote address is allowed
+// to see, newest first.
+func listRecordings(remoteAddr string) ([]recording, error) {
+	all, err := readRecordings()
+	if err != nil {
+		return nil, err
+	}
+	recs := []recording{}
+	for _, rec := range all {
+		c, ok := getCamera(rec.Camera)
+		if !ok || !c.addrAllowed(remoteAddr) {
+			continue
+		}
+		recs = append(recs, rec)
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].Time.After(recs[j].Time) })
+	return recs, nil
+}
+
+// mp4Duration reads the duration out of the movie header.
+func mp4Duration(r io.ReadSeeker) (time.Duration, error) {
+	atoms, err := mp4io.ReadFileAtoms(r)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	for _, a := range atoms {
+		if m, ok := a.(*mp4io.Movie); ok && m.Header != nil && m.Header.TimeScale > 0 {
+			return time.Duration(m.Header.Duration) * time.Second / time.Duration(m.Header.TimeScale), nil
+		}
+	}
+	return 0, errors.New("no movie header")
+}
+
+type playerCmd struct {
+	id       string  // to reply to
+	cmd      string  // play, pause, seek or speed
+	position float64 // seconds, for seek
+	speed    float64 // for speed
+}
+
+// maxPlayerSpeed is as fast as the player will go. much faster and
+// the browser can't keep up.
+const maxPlayerSpeed = 16
+
+// parsePlayerCmd checks a command from the data channel.
+func parsePlayerCmd(req message) (playerCmd, error) {
+	if req.V != protocolVersion {
+		return playerCmd{}, fmt.Errorf("unsupported protocol version %d", req.V)
+	}
+	var args struct {
+		Position float64
+		Speed    float64
+	}
+	if len(req.Args) > 0 {
+		if err := json.Unmarshal(req.Args, &args); err != nil {
+			return playerCmd{}, fmt.Errorf("malformed args for %s", req.Cmd)
+		}
+	}
+	switch req.Cmd {
+	case "play", "pause":
+	case "seek":
+		if args.Position < 0 {
+			return playerCmd{}, fmt.Errorf("can not seek to %v", args.Position)
+		}
+	case "speed":
+		if args.Speed <= 0 || args.Speed > maxPlayerSpeed {
+			return playerCmd{}, fmt.Errorf("speed must be above 0 and at most %d", maxPlayerSpeed)
+		}
+	default:
+		return playerCmd{}, fmt.Errorf("unknown command %q", req.Cmd)
+	}
+	return playerCmd{id: req.ID, cmd: req.Cmd, position: args.Position, speed: args.Speed}, nil
+}
+
+type playerStatus struct {
+	Position float64
+	Duration float64
+	Playing  bool
+	Speed    float64
+}
+
+// player streams one recording to one browser.
+type player struct {
+	c     *camera
+	name  string
+	pc    *webrtc.PeerConnection
+	track *webrtc.TrackLocalStaticSample
+	cmds  chan playerCmd
+
+	f        *os.File
+	demuxer  *mp4.Demuxer
+	codec    h264parser.CodecData
+	idx      int8
+	duration time.Duration
+
+	mu sync.Mutex
+	dc *webrtc.DataChannel
+
+	cancel context.CancelFunc
+	once   sync.Once
+}
+
+// newPlayer starts a player for one of c's recordings. It takes one of c's
+// viewer slots until it's closed.
+func newPlayer(c *camera, name string) (*player, error) {
+	if err := c.addPlayer(); err != nil {
+		return nil, err
+	}
+	p, err := openPlayer(c, name)
+	if err != nil {
+		c.removePlayer()
+		return nil, err
+	}
+	return p, nil
+}
+
+func openPlayer(c *camera, name string) (*player, error) {
+	f, err := os.Open(filepath.Join(outDir, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, err
+	}
+	p := &player{c: c, name: name, f: f, cmds: make(chan playerCmd, 10)}
+	p.duration, err = mp4Duration(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	p.demuxer = mp4.NewDemuxer(f)
+	streams, err := p.demuxer.Streams()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	p.idx = -1
+	for i, s := range streams {
+		if codec, ok := s.(h264parser.CodecData); ok {
+			p.idx, p.codec = int8(i), codec
+			break
+		}
+	}
+	if p.idx < 0 {
+		f.Close()
+		return nil, fmt.Errorf("no h.264 stream in %s", name)
+	}
+
+	p.track, err = webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: "video/h264"}, "v", "v")
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	p.pc, err = webrtcAPI.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	var ctx context.Context
+	ctx, p.cancel = context.WithCancel(context.Background())
+
+	p.pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		p.mu.Lock()
+		p.dc = dc
+		p.mu.Unlock()
+		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+			var req message
+			if err := json.Unmarshal(msg.Data, &req); err != nil {
+				p.send(message{V: protocolVersion, Type: "error", Error: "malformed message"})
+				return
+			}
+			cmd, err := parsePlayerCmd(req)
+			if err != nil {
+				p.reply(req.ID, err)
+				return
+			}
+			select {
+			case p.cmds <- cmd:
+			case <-ctx.Done():
+			}
+		})
+	})
+	watchConnection(p.pc, "playback of "+name, p.close)
+
+	go p.run(ctx)
+	return p, nil
+}
+
+func (p *player) close() {
+	p.once.Do(func() {
+		p.cancel()
+		p.pc.Close()
+		p.c.removePlayer()
+	})
+}
+
+func (p *player) send(msg message) {
+	p.mu.Lock()
+	dc := p.dc
+	p.mu.Unlock()
+	if dc == nil {
+		return
+	}
+	msg.Camera = p.c.id
+	sendMessage(dc, msg)
+}
+
+// reply answers the command with the given id.
+func (p *player) reply(id string, err error) {
+	msg := message{V: protocolVersion, ID: id, Type: "reply"}
+	if err != nil {
+		msg.Type, msg.Error = "error", err.Error()
+	}
+	p.send(msg)
+}
+
+// run paces frames out to the track by their timestamps, scaled by the
+// playback speed, until ctx is done.
+func (p *player) run(ctx context.Context) {
+	defer p.f.Close()
+
+	playing := true
+	speed := 1.0
+	position := time.Duration(0)
+
+	// wall clock time at which media time base is due. resync is set
+	// whenever that relationship has to be worked out again.
+	var start time.Time
+	var base time.Duration
+	resync := true
+
+	var next *frame
+	var nextTime time.Duration
+
+	status := time.NewTicker(time.Second)
+	defer status.Stop()
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		if playing && next == nil {
+			pkt, err := p.demuxer.ReadPacket()
+			switch {
+			case err == io.EOF:
+				playing = false
+				position = p.duration
+			case err != nil:
+				log.Printf("could not read %s: %v", p.name, err)
+				p.close()
+				return
+			case pkt.Idx == p.idx:
+				next = &frame{
+					data:     avccToAnnexB(pkt.Data, p.codec, pkt.IsKeyFrame),
+					keyframe: pkt.IsKeyFrame,
+				}
+				nextTime = pkt.Time
+				if resync {
+					start, base = time.Now(), pkt.Time
+					next.duration = time.Millisecond
+					resync = false
+				} else {
+					next.duration = time.Duration(float64(pkt.Time-position) / speed)
+				}
+			default:
+				continue
+			}
+		}
+
+		var due <-chan time.Time
+		if playing && next != nil {
+			timer.Reset(time.Until(start.Add(time.Duration(float64(nextTime-base) / speed))))
+			due = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case cmd := <-p.cmds:
+			var err error
+			switch cmd.cmd {
+			case "play":
+				if !playing && position >= p.duration {
+					// start over from the end.
+					p.demuxer.SeekToTime(0)
+					position = 0
+				}
+				playing = true
+			case "pause":
+				playing = false
+			case "seek":
+				pos := time.Duration(cmd.position * float64(time.Second))
+				if err = p.demuxer.SeekToTime(pos); err != nil {
+					log.Printf("could not seek %s to %v: %v", p.name, pos, err)
+					err = fmt.Errorf("can not seek to %v", cmd.position)
+					break
+				}
+				next = nil
+				position = pos
+			case "speed":
+				speed = cmd.speed
+			}
+			p.reply(cmd.id, err)
+			resync = true
+			if next != nil {
+				start, base = time.Now(), nextTime
+				resync = false
+			}
+		case <-due:
+			due = nil
+			err := p.track.WriteSample(media.Sample{Data: next.data, Duration: next.duration})
+			if err != nil && err != io.ErrClosedPipe {
+				log.Printf("can not write frame to webrtc track: %v", err)
+			}
+			position = nextTime
+			next = nil
+		case <-status.C:
+			p.send(message{V: protocolVersion, Type: "status", Data: playerStatus{
+				Position: position.Seconds(),
+				Duration: p.duration.Seconds(),
+				Playing:  playing,
+				Speed:    speed,
+			}})
+		}
+		if due != nil && !timer.Stop() {
+			// it went off while we were doing something else.
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+	}
+}
+
+// servePlayback handles /playback/, which is the player page on GET and
+// webrtc signalling for the recording named by the rest of the path on
+// POST.
+func servePlayback(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/playback/")
+	switch r.Method {
+	case http.MethodHead:
+	case http.MethodGet:
+		playbackPage.Execute(w, nil)
+		log.Printf("%s	%s	%s\n", r.RemoteAddr, r.Method, r.URL)
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "unknown method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rec, err := parseRecordingName(name)
+	if err != nil || filepath.Ext(rec.Name) != ".mp4" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	c, ok := getCamera(rec.Camera)
+	if !ok || !c.addrAllowed(r.RemoteAddr) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	var offer webrtc.SessionDescription
+	err = json.NewDecoder(r.Body).Decode(&offer)
+	if err != nil {
+		http.Error(w, "bad times", http.StatusInternalServerError)
+		return
+	}
+
+	p, err := newPlayer(c, rec.Name)
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, errTooManyViewers) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		log.Printf("could not play %s: %v", rec.Name, err)
+		http.Error(w, "bad times", http.StatusInternalServerError)
+		return
+	}
+
+	answer, err := negotiate(p.pc, offer, p.track)
+	if err != nil {
+		p.close()
+		http.Error(w, "bad times", http.StatusInternalServerError)
+		return
+	}
+	w.Write(answer)
+}
+
+// serveRecordings lists recordings as json on /recordings/, and serves
+// the files themselves, e.g. snapshots, below that.
+func serveRecordings(w http.ResponseWriter, r *http.Request) {
+	if name := strings.TrimPrefix(r.URL.Path, "/recordings/"); name != "" {
+		rec, err := parseRecordingName(name)
+		if err != nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		c, ok := getCamera(rec.Camera)
+		if !ok || !c.addrAllowed(r.RemoteAddr) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join(outDir, filepath.FromSlash(rec.Name)))
+		return
+	}
+
+	recs, err := listRecordings(r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "bad times", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(recs)
+}
+
+var playbackPage = template.Must(template.New("playback").Parse(`
+<!doctype html>
+<html dir="auto">
+<meta charset=utf-8>
+<style>
+body {
+	padding: 0;
+	margin: 0;
+	background: black;
+	color: #ffc825;
+	font-family: monospace;
+	display: grid;
+	grid-template-columns: 1fr 300px;
+	height: 100vh;
+}
+video {
+	width: 100%;
+	height: calc(100vh - 40px);
+	background: black;
+}
+#controls {
+	display: flex;
+	gap: 8px;
+	align-items: center;
+	height: 40px;
+	padding: 0 8px;
+}
+#position {
+	flex-grow: 1;
+}
+#recordings {
+	overflow-y: scroll;
+	list-style: none;
+	padding: 8px;
+	margin: 0;
+}
+#recordings li {
+	cursor: pointer;
+	padding: 4px;
+}
+#recordings li.playing {
+	background: #333;
+}
+</style>
+
+<script>
+let pc = null;
+let dc = null;
+let seeking = false;
+let nextID = 1;
+
+function send(cmd, args) {
+	if (dc && dc.readyState === "open") {
+		dc.send(JSON.stringify({V: 1, ID: String(nextID++), Cmd: cmd, Args: args}));
+	}
+}
+
+async function play(name, li) {
+	if (pc) {
+		pc.close();
+	}
+	document.querySelectorAll("#recordings li").forEach(e => e.classList.remove("playing"));
+	li.classList.add("playing");
+
+	pc = new RTCPeerConnection();
+	pc.addTransceiver('video', {direction: 'recvonly'});
+	pc.ontrack = e => {
+		document.querySelector("video").srcObject = e.streams[0];
+	};
+	dc = pc.createDataChannel("d");
+	dc.onmessage = e => {
+		let msg = JSON.parse(e.data);
+		if (msg.Type === "error") {
+			console.log("playback: " + msg.Error);
+			return;
+		}
+		if (msg.Type !== "status") {
+			return;
+		}
+		let s = msg.Data;
+		let pos = document.querySelector("#position");
+		pos.max = s.Duration;
+		if (!seeking) {
+			pos.value = s.Position;
+		}
+		document.querySelector("#playpause").innerText = s.Playing ? "⏸" : "▶";
+		document.querySelector("#time").innerText = s.Position.toFixed(1) + "/" + s.Duration.toFixed(1);
+	};
+
+	let offer = await pc.createOffer();
+	await pc.setLocalDescription(offer);
+	let res = await fetch('/playback/' + name, {method: 'post', body: JSON.stringify(offer)});
+	if (!res.ok) {
+		document.querySelector("#time").innerText = await res.text();
+		return;
+	}
+	await pc.setRemoteDescription(await res.json());
+}
+
+async function main() {
+	let res = await fetch('/recordings/');
+	let recs = await res.json();
+	let ul = document.querySelector("#recordings");
+	for (const r of recs) {
+		let li = document.createElement("li");
+		li.innerText = new Date(r.Time).toLocaleString() + " " + r.Camera;
+		li.onclick = () => play(r.Name, li);
+		ul.appendChild(li);
+	}
+
+	let pos = document.querySelector("#position");
+	pos.addEventListener('input', () => { seeking = true; });
+	pos.addEventListener('change', () => {
+		seeking = false;
+		send("seek", {Position: parseFloat(pos.value)});
+	});
+	document.querySelector("#playpause").onclick = e => {
+		send(e.target.innerText === "▶" ? "play" : "pause");
+	};
+	document.querySelector("#speed").onchange = e => {
+		send("speed", {Speed: parseFloat(e.target.value)});
+	};
+}
+
+document.addEventListener("DOMContentLoaded", main);
+</script>
+<body>
+<div>
+<video autoplay muted playsinline></video>
+<div id="controls">
+<button id="playpause">⏸</button>
+<input id="position" type="range" min="0" max="60" step="0.1" value="0">
+<span id="time"></span>
+<select id="speed">
+<option value="0.5">½×</option>
+<option value="1" selected>1×</option>
+<option value="2">2×</option>
+<option value="4">4×</option>
+<option value="8">8×</option>
+</select>
+</div>
+</div>
+<ul id="recordings"></ul>
+`))
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParsePlayerCmd(t *testing.T) {
+	for _, tt := range []struct {
+		msg  string
+		want playerCmd
+		err  bool
+	}{
+		{`{"V": 1, "ID": "1", "Cmd": "play"}`, playerCmd{id: "1", cmd: "play"}, false},
+		{`{"V": 1, "ID": "2", "Cmd": "pause"}`, playerCmd{id: "2", cmd: "pause"}, false},
+		{`{"V": 1, "ID": "3", "Cmd": "seek", "Args": {"Position": 12.5}}`, playerCmd{id: "3", cmd: "seek", position: 12.5}, false},
+		{`{"V": 1, "ID": "4", "Cmd": "speed", "Args": {"Speed": 4}}`, playerCmd{id: "4", cmd: "speed", speed: 4}, false},
+		{`{"V": 1, "Cmd": "speed", "Args": {"Speed": 0}}`, playerCmd{}, true},
+		{`{"V": 1, "Cmd": "speed", "Args": {"Speed": 32}}`, playerCmd{}, true},
+		{`{"V": 1, "Cmd": "seek", "Args": {"Position": -1}}`, playerCmd{}, true},
+		{`{"V": 1, "Cmd": "seek", "Args": "soon"}`, playerCmd{}, true},
+		{`{"V": 1, "Cmd": "record.start"}`, playerCmd{}, true},
+		// the old unversioned commands.
+		{`{"Cmd": "play"}`, playerCmd{}, true},
+		{`{"V": 2, "Cmd": "play"}`, playerCmd{}, true},
+	} {
+		var req message
+		if err := json.Unmarshal([]byte(tt.msg), &req); err != nil {
+			t.Fatal(err)
+		}
+		got, err := parsePlayerCmd(req)
+		if got != tt.want || (err != nil) != tt.err {
+			t.Errorf("parsePlayerCmd(%s) = %+v, %v, want %+v, error %v", tt.msg, got, err, tt.want, tt.err)
+		}
+	}
+}
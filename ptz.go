@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// pan, tilt and zoom over onvif, see the onvif ptz service spec.
+
+const ptzNS = "http://www.onvif.org/ver20/ptz/wsdl"
+
+var errNoPTZ = errors.New("no ptz configured")
+
+// ptzControl is a camera's onvif ptz service, found on first use.
+type ptzControl struct {
+	sync.Mutex
+	xaddr   string
+	profile string
+}
+
+// ptzRequest is the body of POST /api/cameras/<id>/ptz.
+type ptzRequest struct {
+	Action string // move, stop, goto or setpreset
+
+	// for move, velocities from -1 to 1.
+	Pan, Tilt, Zoom float64
+
+	Preset string // token, for goto, and for setpreset to overwrite one
+	Name   string // for setpreset
+}
+
+type ptzPreset struct {
+	Token string `xml:"token,attr"`
+	Name  string
+}
+
+// ptzService returns the ptz service address and the media profile to
+// send with commands.
+func (c *camera) ptzService(ctx context.Context) (xaddr, profile string, err error) {
+	if !c.ptzEnabled || c.onvif == "" {
+		return "", "", errNoPTZ
+	}
+	c.ptz.Lock()
+	defer c.ptz.Unlock()
+	if c.ptz.xaddr != "" {
+		return c.ptz.xaddr, c.ptz.profile, nil
+	}
+	xaddr, err = onvifService(ctx, c.onvif, "ptz")
+	if err != nil {
+		return "", "", err
+	}
+	media, err := onvifService(ctx, c.onvif, "media")
+	if err != nil {
+		return "", "", err
+	}
+	profiles, err := onvifProfiles(ctx, media)
+	if err != nil {
+		return "", "", err
+	}
+	if len(profiles) == 0 {
+		return "", "", errors.New("camera has no media profiles")
+	}
+	c.ptz.xaddr, c.ptz.profile = xaddr, profiles[0].Token
+	return c.ptz.xaddr, c.ptz.profile, nil
+}
+
+// ptzDo carries out req, returning the new preset's token for setpreset.
+func (c *camera) ptzDo(ctx context.Context, req ptzRequest) (interface{}, error) {
+	xaddr, profile, err := c.ptzService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	token := xmlEscape(profile)
+
+	switch req.Action {
+	case "move":
+		// the timeout stops the camera if we never get to send a stop,
+		// e.g. because the browser went away mid-drag.
+		body := fmt.Sprintf(`<ContinuousMove xmlns="%s"><ProfileToken>%s</ProfileToken>`+
+			`<Velocity><PanTilt xmlns="http://www.onvif.org/ver10/schema" x="%g" y="%g"/>`+
+			`<Zoom xmlns="http://www.onvif.org/ver10/schema" x="%g"/></Velocity>`+
+			`<Timeout>PT10S</Timeout></ContinuousMove>`,
+			ptzNS, token, clamp(req.Pan), clamp(req.Tilt), clamp(req.Zoom))
+		return nil, onvifCall(ctx, xaddr, body, nil)
+
+	case "stop":
+		body := fmt.Sprintf(`<Stop xmlns="%s"><ProfileToken>%s</ProfileToken>`+
+			`<PanTilt>true</PanTilt><Zoom>true</Zoom></Stop>`, ptzNS, token)
+		return nil, onvifCall(ctx, xaddr, body, nil)
+
+	case "goto":
+		if req.Preset == "" {
+			return nil, errors.New("no preset")
+		}
+		body := fmt.Sprintf(`<GotoPreset xmlns="%s"><ProfileToken>%s</ProfileToken>`+
+			`<PresetToken>%s</PresetToken></GotoPreset>`, ptzNS, token, xmlEscape(req.Preset))
+		return nil, onvifCall(ctx, xaddr, body, nil)
+
+	case "setpreset":
+		var b bytes.Buffer
+		fmt.Fprintf(&b, `<SetPreset xmlns="%s"><ProfileToken>%s</ProfileToken>`, ptzNS, token)
+		if req.Name != "" {
+			fmt.Fprintf(&b, `<PresetName>%s</PresetName>`, xmlEscape(req.Name))
+		}
+		if req.Preset != "" {
+			fmt.Fprintf(&b, `<PresetToken>%s</PresetToken>`, xmlEscape(req.Preset))
+		}
+		b.WriteString(`</SetPreset>`)
+		var resp struct {
+			PresetToken string
+		}
+		err := onvifCall(ctx, xaddr, b.String(), &resp)
+		if err != nil {
+			return nil, err
+		}
+		return ptzPreset{Token: resp.PresetToken, Name: req.Name}, nil
+	}
+	return nil, fmt.Errorf("unknown ptz action %q", req.Action)
+}
+
+func (c *camera) ptzPresets(ctx context.Context) ([]ptzPreset, error) {
+	xaddr, profile, err := c.ptzService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Preset []ptzPreset
+	}
+	err = onvifCall(ctx, xaddr, fmt.Sprintf(`<GetPresets xmlns="%s"><ProfileToken>%s</ProfileToken></GetPresets>`,
+		ptzNS, xmlEscape(profile)), &resp)
+	if resp.Preset == nil {
+		resp.Preset = []ptzPreset{}
+	}
+	return resp.Preset, err
+}
+
+func clamp(v float64) float64 {
+	if v < -1 {
+		return -1
+	}
+	if v > 1 {
+		return 1
+	}
+	return v
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
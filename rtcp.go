@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// rtcp receiver reports, see rfc 3550 section 6.4.2 and appendix a.8 for
+// the arithmetic. some cameras drop sessions they never hear from, and the
+// reports are how they find out how their stream is getting on.
+
+const rtcpInterval = 5 * time.Second
+
+// errSessionEnded is for streams the camera says goodbye on.
+var errSessionEnded = errors.New("rtsp session ended")
+
+// rtcpReceiver keeps what's needed to report on one sender's stream.
+// It's used from both the rtp and rtcp readers, so it has a lock.
+type rtcpReceiver struct {
+	mu   sync.Mutex
+	ssrc uint32 // ours
+
+	sender   uint32 // the camera's
+	started  bool
+	epoch    time.Time // first arrival, for jitter
+	baseSeq  uint16
+	maxSeq   uint16
+	cycles   uint32 // sequence number wraparounds, shifted by 16
+	received uint32
+	transit  uint32
+	jitter   float64 // in rtp clock units
+
+	// at the last report.
+	expectedPrior uint32
+	receivedPrior uint32
+
+	srFrom   uint32 // whose the last sender report was
+	lastSR   uint32 // middle 32 bits of its ntp time
+	lastSRAt time.Time
+}
+
+func newRTCPReceiver() *rtcpReceiver {
+	return &rtcpReceiver{ssrc: rand.Uint32()}
+}
+
+// rtp notes a packet, as it comes off the network.
+func (r *rtcpReceiver) rtp(p *rtp.Packet, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.started || p.SSRC != r.sender {
+		// a new stream, or the camera restarted its old one.
+		r.sender, r.started, r.epoch = p.SSRC, true, now
+		r.baseSeq, r.maxSeq, r.cycles = p.SequenceNumber, p.SequenceNumber, 0
+		r.received, r.jitter = 0, 0
+		r.expectedPrior, r.receivedPrior = 0, 0
+	}
+	r.received++
+	if d := p.SequenceNumber - r.maxSeq; d != 0 && d < 0x8000 {
+		if p.SequenceNumber < r.maxSeq {
+			r.cycles += 1 << 16
+		}
+		r.maxSeq = p.SequenceNumber
+	}
+
+	// h.264 is always a 90khz clock. whole seconds and the rest are
+	// scaled apart, since a duration times 90000 overflows after a day.
+	since := now.Sub(r.epoch)
+	arrival := uint32(since/time.Second)*90000 + uint32(since%time.Second*90000/time.Second)
+	transit := arrival - p.Timestamp
+	if r.received > 1 {
+		d := int32(transit - r.transit)
+		if d < 0 {
+			d = -d
+		}
+		r.jitter += (float64(d) - r.jitter) / 16
+	}
+	r.transit = transit
+}
+
+// handle takes a compound rtcp packet from the camera. It returns
+// errSessionEnded if the camera said goodbye.
+func (r *rtcpReceiver) handle(data []byte, now time.Time) error {
+	pkts, err := rtcp.Unmarshal(data)
+	if err != nil {
+		// not worth dropping the stream over.
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, p := range pkts {
+		switch p := p.(type) {
+		case *rtcp.SenderReport:
+			r.srFrom = p.SSRC
+			r.lastSR = uint32(p.NTPTime >> 16)
+			r.lastSRAt = now
+		case *rtcp.Goodbye:
+			for _, s := range p.Sources {
+				if r.started && s == r.sender {
+					return errSessionEnded
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// report returns a receiver report, with an sdes as rfc 3550 requires of
+// compound packets.
+func (r *rtcpReceiver) report(now time.Time) []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rr := &rtcp.ReceiverReport{SSRC: r.ssrc}
+	if r.started {
+		extMax := r.cycles + uint32(r.maxSeq)
+		expected := extMax - uint32(r.baseSeq) + 1
+		lost := int64(expected) - int64(r.received)
+		switch {
+		case lost < 0:
+			// duplicates.
+			lost = 0
+		case lost > 0x7fffff:
+			lost = 0x7fffff
+		}
+		expectedInterval := int64(expected - r.expectedPrior)
+		lostInterval := expectedInterval - int64(r.received-r.receivedPrior)
+		r.expectedPrior, r.receivedPrior = expected, r.received
+		var fraction uint8
+		if expectedInterval > 0 && lostInterval > 0 {
+			fraction = uint8(lostInterval << 8 / expectedInterval)
+		}
+		var lsr, delay uint32
+		if !r.lastSRAt.IsZero() && r.srFrom == r.sender {
+			lsr = r.lastSR
+			delay = uint32(now.Sub(r.lastSRAt) * 65536 / time.Second)
+		}
+		rr.Reports = []rtcp.ReceptionReport{{
+			SSRC:               r.sender,
+			FractionLost:       fraction,
+			TotalLost:          uint32(lost),
+			LastSequenceNumber: extMax,
+			Jitter:             uint32(r.jitter),
+			LastSenderReport:   lsr,
+			Delay:              delay,
+		}}
+	}
+	buf, _ := rtcp.Marshal([]rtcp.Packet{rr, &rtcp.SourceDescription{
+		Chunks: []rtcp.SourceDescriptionChunk{{
+			Source: r.ssrc,
+			Items:  []rtcp.SourceDescriptionItem{{Type: rtcp.SDESCNAME, Text: "dnvr"}},
+		}},
+	}})
+	return buf
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/format/rtmp"
+)
+
+// rtmp ingest, for devices that can only push their video somewhere.
+// they're pointed at rtmp://<dnvr>/live/<id>?key=<stream key>, or, if
+// they ask for a server and a stream key separately, rtmp://<dnvr>/live
+// and <id>?key=<stream key>.
+
+// how long a publisher waits for its camera to take it, e.g. while the
+// last connection is being cleaned up.
+const publishTimeout = 5 * time.Second
+
+func rtmpListenAndServe(addr string) error {
+	s := &rtmp.Server{
+		Addr:          addr,
+		HandlePublish: handlePublish,
+	}
+	return s.ListenAndServe()
+}
+
+func handlePublish(conn *rtmp.Conn) {
+	c, err := publishedCamera(conn.URL)
+	if err != nil {
+		log.Printf("rtmp from %s: %v", conn.NetConn().RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	select {
+	case c.published <- func(ctx context.Context) error { return c.readRTMP(ctx, conn) }:
+		// the camera closes it when it's done.
+	case <-time.After(publishTimeout):
+		log.Printf("%s: rtmp from %s: already being published to", c.id, conn.NetConn().RemoteAddr())
+		conn.Close()
+	}
+}
+
+// publishedCamera returns the camera a publish url is for, if its stream
+// key is right.
+func publishedCamera(u *url.URL) (*camera, error) {
+	if u == nil || !strings.HasPrefix(u.Path, "/live/") {
+		return nil, errors.New("not a /live/ url")
+	}
+	id := strings.TrimPrefix(u.Path, "/live/")
+	c, ok := getCamera(id)
+	if !ok || !strings.HasPrefix(c.src, "rtmp:") {
+		return nil, fmt.Errorf("no rtmp source %q", id)
+	}
+	key := u.Query().Get("key")
+	if subtle.ConstantTimeCompare([]byte(key), []byte(c.streamKey)) != 1 {
+		return nil, fmt.Errorf("wrong stream key for %s", id)
+	}
+	return c, nil
+}
+
+// readRTMP reads video from a device pushing to us, until it stops or ctx
+// is done.
+func (c *camera) readRTMP(ctx context.Context, conn *rtmp.Conn) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	streams, err := conn.Streams()
+	if err != nil {
+		return fmt.Errorf("can not get streams: %w", err)
+	}
+	idx := -1
+	var codec h264parser.CodecData
+	for i, s := range streams {
+		if h, ok := s.(h264parser.CodecData); ok {
+			idx, codec = i, h
+			break
+		}
+	}
+	if idx < 0 {
+		return fmt.Errorf("%w: no h.264 video", errUnsupportedCodec)
+	}
+	log.Printf("%s: rtmp from %s", c.id, conn.NetConn().RemoteAddr())
+
+	var position time.Duration
+	for {
+		p, err := conn.ReadPacket()
+		if err != nil {
+			return fmt.Errorf("can not read packet: %w", err)
+		}
+		if int(p.Idx) != idx {
+			continue
+		}
+		err = c.writeFrame(frame{
+			// ffmpeg wants the sps and pps on every frame.
+			data:     avccToAnnexB(p.Data, codec, true),
+			duration: p.Time - position,
+			keyframe: p.IsKeyFrame,
+		})
+		if err != nil {
+			return fmt.Errorf("can not write frame: %w", err)
+		}
+		position = p.Time
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// rtp over udp arrives out of order, twice, or not at all. the reorder
+// buffer holds on to packets that arrive early for a little while, in
+// case the ones before them turn up.
+const (
+	maxReorderPackets = 64
+	maxReorderDelay   = 200 * time.Millisecond
+)
+
+// rtpStats counts what happened to a stream's packets.
+type rtpStats struct {
+	Packets   uint64 // received
+	Lost      uint64 // never arrived, or arrived too late to use
+	Reordered uint64 // arrived after packets that should have followed them
+	Late      uint64 // arrived after we'd given up on them
+}
+
+type reorderBuffer struct {
+	rtpStats
+
+	next    uint16 // sequence number we're waiting for
+	started bool
+	pending map[uint16]*rtp.Packet
+	since   time.Time // when we started waiting for next
+}
+
+// push adds a packet and returns the packets that are now in order.
+func (b *reorderBuffer) push(p *rtp.Packet, now time.Time) []*rtp.Packet {
+	b.Packets++
+	if !b.started {
+		b.started = true
+		b.next = p.SequenceNumber
+		b.pending = map[uint16]*rtp.Packet{}
+	}
+
+	switch diff := int16(p.SequenceNumber - b.next); {
+	case diff < -maxReorderPackets*4 || diff > maxReorderPackets*4:
+		// way off. the camera probably restarted its stream.
+		b.next = p.SequenceNumber
+		b.pending = map[uint16]*rtp.Packet{}
+	case diff < 0:
+		b.Late++
+		return nil
+	case diff > 0:
+		if _, dup := b.pending[p.SequenceNumber]; !dup {
+			if len(b.pending) == 0 {
+				b.since = now
+			}
+			b.pending[p.SequenceNumber] = p
+		}
+		if len(b.pending) < maxReorderPackets && now.Sub(b.since) < maxReorderDelay {
+			return nil
+		}
+		// give up on what's missing and carry on from the earliest
+		// packet we have.
+		for len(b.pending) > 0 {
+			if _, ok := b.pending[b.next]; ok {
+				break
+			}
+			b.next++
+			b.Lost++
+		}
+		return b.drain(nil, now)
+	}
+
+	if len(b.pending) > 0 {
+		b.Reordered++
+	}
+	out := []*rtp.Packet{p}
+	b.next++
+	return b.drain(out, now)
+}
+
+func (b *reorderBuffer) drain(out []*rtp.Packet, now time.Time) []*rtp.Packet {
+	for {
+		p, ok := b.pending[b.next]
+		if !ok {
+			break
+		}
+		delete(b.pending, b.next)
+		out = append(out, p)
+		b.next++
+	}
+	if len(b.pending) > 0 {
+		b.since = now
+	}
+	return out
+}
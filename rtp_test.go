@@ -0,0 +1,112 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+func seqs(ps []*rtp.Packet) []uint16 {
+	var s []uint16
+	for _, p := range ps {
+		s = append(s, p.SequenceNumber)
+	}
+	return s
+}
+
+func TestReorderBuffer(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	for _, tt := range []struct {
+		name  string
+		in    []uint16
+		at    []time.Duration // when each packet arrives, default start
+		want  []uint16
+		stats rtpStats
+	}{
+		{
+			name:  "in order",
+			in:    []uint16{10, 11, 12},
+			want:  []uint16{10, 11, 12},
+			stats: rtpStats{Packets: 3},
+		},
+		{
+			name:  "wraps",
+			in:    []uint16{65534, 65535, 0, 1},
+			want:  []uint16{65534, 65535, 0, 1},
+			stats: rtpStats{Packets: 4},
+		},
+		{
+			name:  "swapped",
+			in:    []uint16{10, 12, 11, 13},
+			want:  []uint16{10, 11, 12, 13},
+			stats: rtpStats{Packets: 4, Reordered: 1},
+		},
+		{
+			name:  "duplicate",
+			in:    []uint16{10, 12, 12, 11, 11},
+			want:  []uint16{10, 11, 12},
+			stats: rtpStats{Packets: 5, Reordered: 1, Late: 1},
+		},
+		{
+			name:  "lost, then late",
+			in:    []uint16{10, 12, 13, 11},
+			at:    []time.Duration{0, 0, maxReorderDelay, maxReorderDelay},
+			want:  []uint16{10, 12, 13},
+			stats: rtpStats{Packets: 4, Lost: 1, Late: 1},
+		},
+		{
+			name:  "restarted",
+			in:    []uint16{10, 11, 5000, 5001},
+			want:  []uint16{10, 11, 5000, 5001},
+			stats: rtpStats{Packets: 4},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var b reorderBuffer
+			var got []uint16
+			for i, seq := range tt.in {
+				now := start
+				if tt.at != nil {
+					now = now.Add(tt.at[i])
+				}
+				got = append(got, seqs(b.push(&rtp.Packet{Header: rtp.Header{SequenceNumber: seq}}, now))...)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if b.rtpStats != tt.stats {
+				t.Errorf("stats %+v, want %+v", b.rtpStats, tt.stats)
+			}
+		})
+	}
+}
+
+func TestReorderBufferFull(t *testing.T) {
+	// with the buffer full we stop waiting, however soon it is.
+	var b reorderBuffer
+	now := time.Now()
+	b.push(&rtp.Packet{Header: rtp.Header{SequenceNumber: 0}}, now)
+	var got []uint16
+	for i := 0; i < maxReorderPackets; i++ {
+		got = append(got, seqs(b.push(&rtp.Packet{Header: rtp.Header{SequenceNumber: uint16(2 + i)}}, now))...)
+	}
+	if len(got) != maxReorderPackets || got[0] != 2 || b.Lost != 1 {
+		t.Errorf("got %v, %d lost", got, b.Lost)
+	}
+}
+
+func TestRTCPJitterAfterDays(t *testing.T) {
+	// packets sent and received exactly 40ms apart have no jitter, however
+	// long the stream has been going.
+	r := newRTCPReceiver()
+	start := time.Unix(1600000000, 0)
+	for _, at := range []time.Duration{0, 72 * time.Hour, 72*time.Hour + 40*time.Millisecond} {
+		ts := uint32(at/time.Second)*90000 + uint32(at%time.Second/time.Millisecond)*90
+		r.rtp(&rtp.Packet{Header: rtp.Header{SSRC: 1, Timestamp: ts}}, start.Add(at))
+	}
+	if r.jitter != 0 {
+		t.Errorf("jitter %v, want 0", r.jitter)
+	}
+}
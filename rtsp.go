@@ -2,14 +2,20 @@ package main
 
 import (
 	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"net/textproto"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 type request struct {
@@ -81,9 +87,13 @@ func (req *request) Write(w io.Writer) error {
 		}
 	}
 
+	if len(req.Body) > 0 && req.Header.Get("Content-Length") == "" {
+		fmt.Fprintf(bw, "Content-Length: %d\r\n", len(req.Body))
+	}
+
 	fmt.Fprintf(bw, "\r\n")
+	bw.Write(req.Body)
 	return bw.Flush()
-	//TODO body
 }
 
 type response struct {
@@ -148,7 +158,268 @@ func readResponse(r *bufio.Reader) (*response, error) {
 	return resp, nil
 }
 
+func (resp *response) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	_, err := fmt.Fprintf(bw, "%s %s\r\n", resp.Proto, resp.Status)
+	if err != nil {
+		return err
+	}
+
+	for k, vs := range resp.Header {
+		if k == "Cseq" {
+			k = "CSeq"
+		}
+		for _, v := range vs {
+			fmt.Fprintf(bw, "%s: %s\r\n", headerNewlineToSpace.Replace(k), headerNewlineToSpace.Replace(v))
+		}
+	}
+
+	if len(resp.Body) > 0 && resp.Header.Get("Content-Length") == "" {
+		fmt.Fprintf(bw, "Content-Length: %d\r\n", len(resp.Body))
+	}
+
+	fmt.Fprintf(bw, "\r\n")
+	bw.Write(resp.Body)
+	return bw.Flush()
+}
+
 func basicAuth(username, password string) string {
 	auth := username + ":" + password
 	return base64.StdEncoding.EncodeToString([]byte(auth))
 }
+
+// authenticator answers a server's WWW-Authenticate challenges with the
+// credentials from a camera url. It does basic and digest, as described in
+// rfc 7617 and rfc 7616 (and rfc 2617 before them). Nothing is sent until
+// the server has asked for it, so passwords don't go out in the clear to
+// servers that would have taken digest.
+type authenticator struct {
+	user *url.Userinfo
+
+	mu     sync.Mutex
+	scheme string            // "basic" or "digest" once challenged
+	params map[string]string // from the digest challenge
+	nc     int               // nonce count
+	cnonce string
+}
+
+func newAuthenticator(user *url.Userinfo) *authenticator {
+	return &authenticator{user: user}
+}
+
+// challenge takes in a 401 response. It reports whether the request is
+// worth trying again, i.e. whether we have credentials and they haven't
+// already been turned down.
+func (a *authenticator) challenge(resp *response) bool {
+	if a == nil || a.user == nil {
+		return false
+	}
+	var best *authChallenge
+	for _, c := range parseChallenges(resp.Header.Values("WWW-Authenticate")) {
+		c := c
+		if best == nil || c.strength() > best.strength() {
+			best = &c
+		}
+	}
+	if best == nil || best.strength() == 0 {
+		return false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch {
+	case best.scheme == "basic" && a.scheme == "basic":
+		// we sent basic and it didn't work.
+		return false
+	case best.scheme == "digest" && a.scheme == "digest" &&
+		best.params["nonce"] == a.params["nonce"] && !strings.EqualFold(best.params["stale"], "true"):
+		// same nonce and it's not stale, so it's the password.
+		return false
+	}
+	a.scheme, a.params, a.nc = best.scheme, best.params, 0
+	if a.scheme == "digest" {
+		var b [8]byte
+		rand.Read(b[:])
+		a.cnonce = hex.EncodeToString(b[:])
+	}
+	return true
+}
+
+// authorization returns the Authorization header for a request, or "" if
+// the server hasn't asked for one. uri must be the request uri exactly as
+// it is sent.
+func (a *authenticator) authorization(method, uri string, body []byte) string {
+	if a == nil || a.user == nil {
+		return ""
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	username := a.user.Username()
+	password, _ := a.user.Password()
+	switch a.scheme {
+	case "basic":
+		return "Basic " + basicAuth(username, password)
+	case "digest":
+		return a.digest(method, uri, body, username, password)
+	}
+	return ""
+}
+
+func (a *authenticator) digest(method, uri string, body []byte, username, password string) string {
+	p := a.params
+	algorithm := p["algorithm"]
+	newHash, sess := digestAlgorithm(algorithm)
+	h := func(s string) string {
+		hh := newHash()
+		io.WriteString(hh, s)
+		return hex.EncodeToString(hh.Sum(nil))
+	}
+
+	realm, nonce := p["realm"], p["nonce"]
+	ha1 := h(username + ":" + realm + ":" + password)
+	if sess {
+		ha1 = h(ha1 + ":" + nonce + ":" + a.cnonce)
+	}
+
+	qop := ""
+	for _, q := range strings.Split(p["qop"], ",") {
+		q = strings.TrimSpace(q)
+		if q == "auth" || (q == "auth-int" && qop == "") {
+			qop = q
+		}
+	}
+	ha2 := h(method + ":" + uri)
+	if qop == "auth-int" {
+		ha2 = h(method + ":" + uri + ":" + h(string(body)))
+	}
+
+	var response, nc string
+	if qop == "" {
+		response = h(ha1 + ":" + nonce + ":" + ha2)
+	} else {
+		a.nc++
+		nc = fmt.Sprintf("%08x", a.nc)
+		response = h(ha1 + ":" + nonce + ":" + nc + ":" + a.cnonce + ":" + qop + ":" + ha2)
+	}
+
+	userhash := strings.EqualFold(p["userhash"], "true")
+	if userhash {
+		username = h(username + ":" + realm)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Digest username=%s, realm=%s, nonce=%s, uri=%s, response=%s",
+		quote(username), quote(realm), quote(nonce), quote(uri), quote(response))
+	if algorithm != "" {
+		fmt.Fprintf(&b, ", algorithm=%s", algorithm)
+	}
+	if opaque, ok := p["opaque"]; ok {
+		fmt.Fprintf(&b, ", opaque=%s", quote(opaque))
+	}
+	if qop != "" {
+		fmt.Fprintf(&b, ", qop=%s, nc=%s, cnonce=%s", qop, nc, quote(a.cnonce))
+	}
+	if userhash {
+		fmt.Fprintf(&b, ", userhash=true")
+	}
+	return b.String()
+}
+
+// digestAlgorithm returns the hash for a digest algorithm, and whether
+// it's a -sess variant. It returns nil for algorithms we don't know.
+func digestAlgorithm(algorithm string) (func() hash.Hash, bool) {
+	name := strings.ToUpper(algorithm)
+	sess := strings.HasSuffix(name, "-SESS")
+	switch strings.TrimSuffix(name, "-SESS") {
+	case "", "MD5":
+		return md5.New, sess
+	case "SHA-256":
+		return sha256.New, sess
+	}
+	return nil, false
+}
+
+type authChallenge struct {
+	scheme string // lower case
+	params map[string]string
+}
+
+// strength orders challenges by preference. 0 means we can't answer it.
+func (c authChallenge) strength() int {
+	switch c.scheme {
+	case "basic":
+		return 1
+	case "digest":
+		newHash, _ := digestAlgorithm(c.params["algorithm"])
+		if newHash == nil || c.params["nonce"] == "" {
+			return 0
+		}
+		if strings.HasPrefix(strings.ToUpper(c.params["algorithm"]), "SHA-256") {
+			return 3
+		}
+		return 2
+	}
+	return 0
+}
+
+// parseChallenges parses WWW-Authenticate headers. Each header may hold
+// more than one challenge, e.g.
+//
+//	Digest realm="cam", nonce="abc", algorithm=MD5, Basic realm="cam"
+func parseChallenges(headers []string) []authChallenge {
+	var cs []authChallenge
+	for _, s := range headers {
+		for {
+			s = strings.TrimLeft(s, " \t,")
+			tok, rest := authToken(s)
+			if tok == "" {
+				break
+			}
+			rest = strings.TrimLeft(rest, " \t")
+			if !strings.HasPrefix(rest, "=") || len(cs) == 0 {
+				cs = append(cs, authChallenge{scheme: strings.ToLower(tok), params: map[string]string{}})
+				s = rest
+				continue
+			}
+			rest = strings.TrimLeft(rest[1:], " \t")
+			var v string
+			if strings.HasPrefix(rest, `"`) {
+				v, rest = authQuoted(rest)
+			} else {
+				v, rest = authToken(rest)
+			}
+			cs[len(cs)-1].params[strings.ToLower(tok)] = v
+			s = rest
+		}
+	}
+	return cs
+}
+
+func authToken(s string) (tok, rest string) {
+	i := strings.IndexAny(s, " \t,=\"")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i:]
+}
+
+func authQuoted(s string) (v, rest string) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return b.String(), s[i+1:]
+		case '\\':
+			if i+1 < len(s) {
+				i++
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String(), ""
+}
+
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"net/textproto"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func challengeResponse(headers ...string) *response {
+	resp := fakeResponse(401)
+	resp.Header = textproto.MIMEHeader{"Www-Authenticate": headers}
+	return resp
+}
+
+// authParams parses an Authorization header the way a server would.
+func authParams(t *testing.T, auth string) (string, map[string]string) {
+	t.Helper()
+	if strings.HasPrefix(auth, "Basic ") {
+		return "basic", map[string]string{}
+	}
+	cs := parseChallenges([]string{auth})
+	if len(cs) != 1 {
+		t.Fatalf("can not parse %q", auth)
+	}
+	return cs[0].scheme, cs[0].params
+}
+
+func TestDigestRFC7616(t *testing.T) {
+	// the examples in section 3.9.1 of rfc 7616.
+	const (
+		nonce  = "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v"
+		opaque = "FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"
+		cnonce = "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ"
+	)
+	for _, tt := range []struct {
+		algorithm, response string
+	}{
+		{"MD5", "8ca523f5e9506fed4657c9700eebdbec"},
+		{"SHA-256", "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+	} {
+		a := newAuthenticator(url.UserPassword("Mufasa", "Circle of Life"))
+		ok := a.challenge(challengeResponse(`Digest realm="http-auth@example.org", qop="auth, auth-int", algorithm=` +
+			tt.algorithm + `, nonce="` + nonce + `", opaque="` + opaque + `"`))
+		if !ok {
+			t.Fatalf("%s: challenge not taken", tt.algorithm)
+		}
+		a.cnonce = cnonce
+		scheme, p := authParams(t, a.authorization("GET", "/dir/index.html", nil))
+		want := map[string]string{
+			"username":  "Mufasa",
+			"realm":     "http-auth@example.org",
+			"uri":       "/dir/index.html",
+			"algorithm": tt.algorithm,
+			"nonce":     nonce,
+			"nc":        "00000001",
+			"cnonce":    cnonce,
+			"qop":       "auth",
+			"response":  tt.response,
+			"opaque":    opaque,
+		}
+		if scheme != "digest" || !reflect.DeepEqual(p, want) {
+			t.Errorf("%s: got %s %v, want digest %v", tt.algorithm, scheme, p, want)
+		}
+
+		// the nonce count goes up with each request.
+		_, p = authParams(t, a.authorization("GET", "/dir/index.html", nil))
+		if p["nc"] != "00000002" {
+			t.Errorf("%s: second nc = %s", tt.algorithm, p["nc"])
+		}
+	}
+}
+
+func TestDigestRFC2617(t *testing.T) {
+	// the example in section 3.5 of rfc 2617.
+	a := newAuthenticator(url.UserPassword("Mufasa", "Circle Of Life"))
+	a.challenge(challengeResponse(`Digest realm="testrealm@host.com", qop="auth,auth-int", ` +
+		`nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", opaque="5ccc069c403ebaf9f0171e9517f40e41"`))
+	a.cnonce = "0a4f113b"
+	_, p := authParams(t, a.authorization("GET", "/dir/index.html", nil))
+	if want := "6629fae49393a05397450978507c4ef1"; p["response"] != want {
+		t.Errorf("response = %s, want %s", p["response"], want)
+	}
+	if _, ok := p["algorithm"]; ok {
+		t.Errorf("algorithm sent when the server didn't give one: %v", p)
+	}
+}
+
+func md5hex(s string) string {
+	h := md5.Sum([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+func TestDigestVariants(t *testing.T) {
+	const uri = "rtsp://cam/stream"
+	body := []byte("v=0\r\n")
+	ha1 := md5hex("admin:cam:secret")
+	for _, tt := range []struct {
+		name, challenge, want string
+	}{
+		{
+			"no qop",
+			`Digest realm="cam", nonce="n1"`,
+			md5hex(ha1 + ":n1:" + md5hex("DESCRIBE:"+uri)),
+		},
+		{
+			"auth-int only",
+			`Digest realm="cam", nonce="n1", qop="auth-int"`,
+			md5hex(ha1 + ":n1:00000001:c:auth-int:" + md5hex("DESCRIBE:"+uri+":"+md5hex(string(body)))),
+		},
+		{
+			"sess",
+			`Digest realm="cam", nonce="n1", qop="auth", algorithm=MD5-sess`,
+			md5hex(md5hex(ha1+":n1:c") + ":n1:00000001:c:auth:" + md5hex("DESCRIBE:"+uri)),
+		},
+	} {
+		a := newAuthenticator(url.UserPassword("admin", "secret"))
+		if !a.challenge(challengeResponse(tt.challenge)) {
+			t.Errorf("%s: challenge not taken", tt.name)
+			continue
+		}
+		a.cnonce = "c"
+		_, p := authParams(t, a.authorization("DESCRIBE", uri, body))
+		if p["response"] != tt.want {
+			t.Errorf("%s: response = %s, want %s", tt.name, p["response"], tt.want)
+		}
+	}
+}
+
+func TestDigestUserhash(t *testing.T) {
+	a := newAuthenticator(url.UserPassword("admin", "secret"))
+	a.challenge(challengeResponse(`Digest realm="cam", nonce="n1", userhash=true`))
+	_, p := authParams(t, a.authorization("DESCRIBE", "rtsp://cam/", nil))
+	if p["username"] != md5hex("admin:cam") || p["userhash"] != "true" {
+		t.Errorf("got %v", p)
+	}
+}
+
+func TestParseChallenges(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		headers []string
+		want    []authChallenge
+	}{
+		{
+			"quoted commas",
+			[]string{`Digest realm="cams, front door", nonce="a,b", qop="auth,auth-int"`},
+			[]authChallenge{{"digest", map[string]string{"realm": "cams, front door", "nonce": "a,b", "qop": "auth,auth-int"}}},
+		},
+		{
+			"several in one header",
+			[]string{`Digest realm="cam", nonce="abc", algorithm=MD5, Basic realm="cam"`},
+			[]authChallenge{
+				{"digest", map[string]string{"realm": "cam", "nonce": "abc", "algorithm": "MD5"}},
+				{"basic", map[string]string{"realm": "cam"}},
+			},
+		},
+		{
+			"several headers",
+			[]string{`Basic realm="cam"`, `Digest realm="cam", nonce="abc"`},
+			[]authChallenge{
+				{"basic", map[string]string{"realm": "cam"}},
+				{"digest", map[string]string{"realm": "cam", "nonce": "abc"}},
+			},
+		},
+		{
+			"escapes and odd spacing",
+			[]string{`DIGEST Realm = "say \"hi\"" ,NONCE=abc,stale=TRUE`},
+			[]authChallenge{{"digest", map[string]string{"realm": `say "hi"`, "nonce": "abc", "stale": "TRUE"}}},
+		},
+		{
+			"scheme without params",
+			[]string{`Negotiate, Basic realm="cam"`},
+			[]authChallenge{
+				{"negotiate", map[string]string{}},
+				{"basic", map[string]string{"realm": "cam"}},
+			},
+		},
+	} {
+		if got := parseChallenges(tt.headers); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestChallengeChoice(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		headers   []string
+		scheme    string
+		algorithm string
+	}{
+		{"digest over basic", []string{`Basic realm="cam"`, `Digest realm="cam", nonce="n"`}, "digest", ""},
+		{"sha-256 over md5", []string{`Digest realm="cam", nonce="n", algorithm=MD5, Digest realm="cam", nonce="n", algorithm=SHA-256`}, "digest", "SHA-256"},
+		{"unknown algorithm skipped", []string{`Digest realm="cam", nonce="n", algorithm=SHA-512-256, Digest realm="cam", nonce="n", algorithm=MD5`}, "digest", "MD5"},
+		{"digest without nonce skipped", []string{`Digest realm="cam", Basic realm="cam"`}, "basic", ""},
+	} {
+		a := newAuthenticator(url.UserPassword("admin", "secret"))
+		if !a.challenge(challengeResponse(tt.headers...)) {
+			t.Errorf("%s: challenge not taken", tt.name)
+			continue
+		}
+		scheme, p := authParams(t, a.authorization("DESCRIBE", "rtsp://cam/", nil))
+		if scheme != tt.scheme || p["algorithm"] != tt.algorithm {
+			t.Errorf("%s: answered %s %v", tt.name, scheme, p)
+		}
+	}
+}
+
+func TestChallengeRetries(t *testing.T) {
+	a := newAuthenticator(url.UserPassword("admin", "wrong"))
+	digest := challengeResponse(`Digest realm="cam", nonce="n1"`)
+	if !a.challenge(digest) {
+		t.Fatal("first challenge not taken")
+	}
+	if a.challenge(digest) {
+		t.Error("retried with the same nonce")
+	}
+	if !a.challenge(challengeResponse(`Digest realm="cam", nonce="n1", stale=true`)) {
+		t.Error("didn't retry a stale nonce")
+	}
+	if !a.challenge(challengeResponse(`Digest realm="cam", nonce="n2"`)) {
+		t.Error("didn't retry a new nonce")
+	}
+
+	b := newAuthenticator(url.UserPassword("admin", "wrong"))
+	basic := challengeResponse(`Basic realm="cam"`)
+	if !b.challenge(basic) || b.challenge(basic) {
+		t.Error("basic should be tried once")
+	}
+
+	if newAuthenticator(nil).challenge(digest) {
+		t.Error("retried without credentials")
+	}
+	if b := newAuthenticator(url.UserPassword("admin", "x")); b.authorization("DESCRIBE", "rtsp://cam/", nil) != "" {
+		t.Error("sent credentials before being asked")
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// rtspClient is a bare bones rtsp client session, enough to set up a
+// stream and push or pull interleaved rtp over it.
+type rtspClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+	url  *url.URL // without userinfo
+	auth *authenticator
+
+	// Header is sent with every request, e.g. Require.
+	Header textproto.MIMEHeader
+
+	cseq    int
+	session string
+
+	wmu sync.Mutex // serialises writes to conn
+}
+
+// dialRTSP connects to an rtsp:// or rtsps:// url. tlsConfig is only
+// used for rtsps and may be nil.
+func dialRTSP(rawurl string, tlsConfig *tls.Config) (*rtspClient, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialCamera(u, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	auth := newAuthenticator(u.User)
+	u.User = nil
+	return &rtspClient{
+		conn:   conn,
+		r:      bufio.NewReader(conn),
+		url:    u,
+		auth:   auth,
+		Header: textproto.MIMEHeader{},
+	}, nil
+}
+
+// dialCamera opens a connection to the host in an rtsp or rtsps url.
+func dialCamera(u *url.URL, tlsConfig *tls.Config) (net.Conn, error) {
+	d := &net.Dialer{Timeout: 10 * time.Second}
+	switch u.Scheme {
+	case "rtsp":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "554")
+		}
+		return d.Dial("tcp", host)
+	case "rtsps":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "322")
+		}
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		return tls.DialWithDialer(d, "tcp", host, tlsConfig)
+	}
+	return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+}
+
+func (c *rtspClient) Close() error {
+	return c.conn.Close()
+}
+
+// do sends a request for u and waits for its response. Interleaved
+// data that arrives in the meantime is discarded. Responses that are
+// not 2xx are returned as errors. Requests the server wants credentials
+// for are sent again with them.
+func (c *rtspClient) do(method string, u *url.URL, h textproto.MIMEHeader) (*response, error) {
+	if u == nil {
+		u = c.url
+	}
+	resp, err := c.roundTrip(method, u, h)
+	if err == nil && resp.StatusCode == 401 && c.auth.challenge(resp) {
+		resp, err = c.roundTrip(method, u, h)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp, &statusError{Method: method, URL: u, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return resp, nil
+}
+
+// statusError is a response that wasn't 2xx.
+type statusError struct {
+	Method     string
+	URL        *url.URL
+	StatusCode int
+	Status     string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Method, e.URL.Redacted(), e.Status)
+}
+
+func (c *rtspClient) roundTrip(method string, u *url.URL, h textproto.MIMEHeader) (*response, error) {
+	err := c.send(method, u, h)
+	if err != nil {
+		return nil, err
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	defer c.conn.SetReadDeadline(time.Time{})
+	for {
+		b, err := c.r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] == '$' {
+			if _, _, err := readInterleaved(c.r); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		resp, err := readResponse(c.r)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Header.Get("CSeq") != strconv.Itoa(c.cseq) {
+			// a late response to something we gave up on.
+			continue
+		}
+		if s := resp.Header.Get("Session"); s != "" {
+			c.session, _, _ = strings.Cut(s, ";")
+		}
+		return resp, nil
+	}
+}
+
+// send writes a request without waiting for the response. It's for
+// requests like keepalives whose responses nobody cares about, once
+// something else is reading from the connection.
+func (c *rtspClient) send(method string, u *url.URL, h textproto.MIMEHeader) error {
+	if u == nil {
+		u = c.url
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.cseq++
+	req := &request{
+		Method: method,
+		URL:    u,
+		Header: textproto.MIMEHeader{},
+	}
+	for k, vs := range c.Header {
+		req.Header[k] = vs
+	}
+	for k, vs := range h {
+		req.Header[k] = vs
+	}
+	req.Header.Set("CSeq", strconv.Itoa(c.cseq))
+	req.Header.Set("User-Agent", "dnvr")
+	if c.session != "" {
+		req.Header.Set("Session", c.session)
+	}
+	if auth := c.auth.authorization(method, u.String(), nil); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return req.Write(c.conn)
+}
+
+// discard reads and throws away everything the server sends until the
+// connection breaks. Once it's running only send may be used.
+func (c *rtspClient) discard() error {
+	for {
+		b, err := c.r.Peek(1)
+		if err != nil {
+			return err
+		}
+		if b[0] == '$' {
+			_, _, err = readInterleaved(c.r)
+		} else {
+			_, err = readResponse(c.r)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// describe sends a DESCRIBE and returns the parsed sdp along with the
+// base url for its control attributes.
+func (c *rtspClient) describe() (*sessionDesc, *url.URL, error) {
+	resp, err := c.do("DESCRIBE", nil, textproto.MIMEHeader{"Accept": {"application/sdp"}})
+	if err != nil {
+		return nil, nil, err
+	}
+	base := c.url
+	if cb := resp.Header.Get("Content-Base"); cb != "" {
+		if u, err := url.Parse(cb); err == nil {
+			base = u
+		}
+	}
+	sd, err := parseSDP(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sd, base, nil
+}
+
+// writeInterleaved sends data on an interleaved channel, as described in
+// rfc 2326 section 10.12.
+func (c *rtspClient) writeInterleaved(channel byte, data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return writeInterleaved(c.conn, channel, data)
+}
+
+// readRTP returns the next rtp packet with payload type pt on an
+// interleaved channel. rtcp on the channel after it goes to onRTCP, and
+// everything else is skipped.
+func (c *rtspClient) readRTP(channel byte, pt int, onRTCP func([]byte) error) ([]*rtp.Packet, error) {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(rtpTimeout))
+		b, err := c.r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != '$' {
+			// responses to keepalives.
+			if _, err := readResponse(c.r); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		ch, data, err := readInterleaved(c.r)
+		if err != nil {
+			return nil, err
+		}
+		if ch == channel+1 && onRTCP != nil {
+			if err := onRTCP(data); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var p rtp.Packet
+		if ch != channel || p.Unmarshal(data) != nil || int(p.PayloadType) != pt {
+			continue
+		}
+		return []*rtp.Packet{&p}, nil
+	}
+}
+
+func writeInterleaved(w io.Writer, channel byte, data []byte) error {
+	if len(data) > 0xffff {
+		return fmt.Errorf("interleaved frame too big: %d bytes", len(data))
+	}
+	hdr := []byte{'$', channel, 0, 0}
+	binary.BigEndian.PutUint16(hdr[2:], uint16(len(data)))
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readInterleaved(r *bufio.Reader) (channel byte, data []byte, err error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	if hdr[0] != '$' {
+		return 0, nil, fmt.Errorf("malformed interleaved frame")
+	}
+	data = make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	_, err = io.ReadFull(r, data)
+	return hdr[1], data, err
+}
+
+// cameraTLSConfig returns the tls config for an rtsps camera. caFile is a
+// pem file with the ca, or the camera's own self-signed certificate, to
+// trust instead of the system roots. Cameras rarely have certificates for
+// the address we know them by, so a pinned ca is trusted for any name.
+func cameraTLSConfig(caFile string, skipVerify bool) (*tls.Config, error) {
+	if skipVerify {
+		return &tls.Config{InsecureSkipVerify: true}, nil
+	}
+	if caFile == "" {
+		return nil, nil
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", caFile)
+	}
+	return &tls.Config{
+		// we verify the chain ourselves below, without the name.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			var certs []*x509.Certificate
+			for _, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return err
+				}
+				certs = append(certs, cert)
+			}
+			if len(certs) == 0 {
+				return fmt.Errorf("no certificate from camera")
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range certs[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := certs[0].Verify(x509.VerifyOptions{
+				Roots:         roots,
+				Intermediates: intermediates,
+			})
+			return err
+		},
+	}, nil
+}
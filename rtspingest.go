@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// transports a source can be read over. tcp is interleaved in the rtsp
+// connection, which gets through anything but suffers badly on lossy
+// links. udp and udp-multicast get rtp in udp packets, the latter from a
+// multicast group so other receivers can share the stream. auto tries udp
+// and falls back to tcp if nothing arrives.
+var transports = map[string]bool{
+	"":              true, // tcp
+	"tcp":           true,
+	"udp":           true,
+	"udp-multicast": true,
+	"auto":          true,
+}
+
+// errNoPackets means setup went fine but no rtp ever turned up, which is
+// what udp looks like through a firewall or nat.
+var errNoPackets = errors.New("no rtp packets received")
+
+const (
+	firstPacketTimeout = 5 * time.Second
+	rtpTimeout         = 10 * time.Second
+)
+
+// readRTSPOver reads the camera's video over the given transport, until
+// the stream breaks or ctx is done.
+func (c *camera) readRTSPOver(ctx context.Context, transport string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	rc, err := dialRTSP(c.src, c.tlsConfig)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	sd, base, err := rc.describe()
+	if err != nil {
+		return err
+	}
+	var md *mediaDesc
+	var pt int
+	for _, m := range sd.Media {
+		if m.Type != "video" {
+			continue
+		}
+		for _, f := range m.Formats {
+			if enc, _ := m.rtpmap(f); strings.EqualFold(enc, "H264") {
+				md, pt = m, f
+				break
+			}
+		}
+		if md != nil {
+			break
+		}
+	}
+	if md == nil {
+		return fmt.Errorf("%w: no h.264 video in sdp", errUnsupportedCodec)
+	}
+	ctl, err := md.controlURL(base)
+	if err != nil {
+		return err
+	}
+
+	var rb reorderBuffer
+	recv := newRTCPReceiver()
+	var next func() ([]*rtp.Packet, error)
+	var sendRTCP func([]byte) error // nil if we can't
+	switch transport {
+	case "tcp":
+		resp, err := rc.do("SETUP", ctl, textproto.MIMEHeader{
+			"Transport": {"RTP/AVP/TCP;unicast;interleaved=0-1"},
+		})
+		if err != nil {
+			return err
+		}
+		channel := interleavedChannel(resp.Header.Get("Transport"))
+		onRTCP := func(data []byte) error {
+			return recv.handle(data, time.Now())
+		}
+		next = func() ([]*rtp.Packet, error) {
+			pkts, err := rc.readRTP(channel, pt, onRTCP)
+			for _, p := range pkts {
+				recv.rtp(p, time.Now())
+			}
+			return pkts, err
+		}
+		sendRTCP = func(b []byte) error {
+			return rc.writeInterleaved(channel+1, b)
+		}
+
+	case "udp", "udp-multicast":
+		camIP := rc.conn.RemoteAddr().(*net.TCPAddr).IP
+		var conn, rtcpConn *net.UDPConn
+		if transport == "udp-multicast" {
+			resp, err := rc.do("SETUP", ctl, textproto.MIMEHeader{
+				"Transport": {"RTP/AVP;multicast"},
+			})
+			if err != nil {
+				return err
+			}
+			group, port, err := multicastDestination(resp.Header.Get("Transport"))
+			if err != nil {
+				return err
+			}
+			conn, err = net.ListenMulticastUDP("udp", nil, &net.UDPAddr{IP: group, Port: port})
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			// sender reports come to the group, and receiver reports go
+			// back to it.
+			rtcpAddr := &net.UDPAddr{IP: group, Port: port + 1}
+			rtcpConn, err = net.ListenMulticastUDP("udp", nil, rtcpAddr)
+			if err != nil {
+				return err
+			}
+			defer rtcpConn.Close()
+			sendRTCP = func(b []byte) error {
+				_, err := rtcpConn.WriteToUDP(b, rtcpAddr)
+				return err
+			}
+		} else {
+			conn, rtcpConn, err = listenRTPPair(nil)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			defer rtcpConn.Close()
+			port := conn.LocalAddr().(*net.UDPAddr).Port
+			resp, err := rc.do("SETUP", ctl, textproto.MIMEHeader{
+				"Transport": {fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d", port, port+1)},
+			})
+			if err != nil {
+				return err
+			}
+			if sp := serverRTCPPort(resp.Header.Get("Transport")); sp > 0 {
+				rtcpAddr := &net.UDPAddr{IP: camIP, Port: sp}
+				sendRTCP = func(b []byte) error {
+					_, err := rtcpConn.WriteToUDP(b, rtcpAddr)
+					return err
+				}
+			}
+		}
+		go func() {
+			<-ctx.Done()
+			conn.Close()
+			rtcpConn.Close()
+		}()
+		go func() {
+			buf := make([]byte, 1500)
+			for {
+				n, addr, err := rtcpConn.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				if transport == "udp" && !addr.IP.Equal(camIP) {
+					continue
+				}
+				if recv.handle(buf[:n], time.Now()) != nil {
+					cancel()
+					return
+				}
+			}
+		}()
+
+		defer func() {
+			if rb.Packets > 0 {
+				log.Printf("%s: rtp over udp: %+v", c.id, rb.rtpStats)
+			}
+		}()
+		logStats := time.NewTicker(time.Minute)
+		defer logStats.Stop()
+
+		buf := make([]byte, 1<<16)
+		next = func() ([]*rtp.Packet, error) {
+			select {
+			case <-logStats.C:
+				if rb.Lost > 0 || rb.Late > 0 {
+					log.Printf("%s: rtp over udp: %+v", c.id, rb.rtpStats)
+				}
+			default:
+			}
+			timeout := rtpTimeout
+			if rb.Packets == 0 {
+				timeout = firstPacketTimeout
+			}
+			for {
+				conn.SetReadDeadline(time.Now().Add(timeout))
+				n, addr, err := conn.ReadFromUDP(buf)
+				if err != nil {
+					if ctx.Err() == nil && rb.Packets == 0 {
+						return nil, errNoPackets
+					}
+					return nil, err
+				}
+				if transport == "udp" && !addr.IP.Equal(camIP) {
+					continue
+				}
+				var p rtp.Packet
+				if p.Unmarshal(append([]byte(nil), buf[:n]...)) != nil || int(p.PayloadType) != pt {
+					continue
+				}
+				now := time.Now()
+				recv.rtp(&p, now)
+				return rb.push(&p, now), nil
+			}
+		}
+
+	default:
+		return fmt.Errorf("unknown transport %q", transport)
+	}
+
+	_, err = rc.do("PLAY", base, textproto.MIMEHeader{"Range": {"npt=0.000-"}})
+	if err != nil {
+		return err
+	}
+
+	if transport != "tcp" {
+		// from here on the rtsp connection is only for keepalives. if it
+		// breaks, the session's gone.
+		go func() {
+			rc.discard()
+			cancel()
+		}()
+	}
+	go func() {
+		<-ctx.Done()
+		rc.Close()
+	}()
+	go func() {
+		t := time.NewTicker(30 * time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				rc.send("GET_PARAMETER", base, nil)
+			}
+		}
+	}()
+	if sendRTCP != nil {
+		go func() {
+			t := time.NewTicker(rtcpInterval)
+			defer t.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case now := <-t.C:
+					sendRTCP(recv.report(now))
+				}
+			}
+		}()
+	}
+	defer rc.send("TEARDOWN", base, nil)
+
+	w := &auWriter{c: c, d: &h264Depacketizer{}}
+	w.d.sps, w.d.pps = spropParameterSets(md.fmtp(pt))
+	for {
+		pkts, err := next()
+		if err != nil {
+			if err != errNoPackets && ctx.Err() != nil {
+				return errSessionEnded
+			}
+			return err
+		}
+		for _, p := range pkts {
+			w.d.push(p, w.emit)
+		}
+		if rb.Packets > 0 {
+			c.stats.setRTP(rb.rtpStats)
+		}
+		if w.err != nil {
+			return fmt.Errorf("can not write frame: %v", w.err)
+		}
+	}
+}
+
+// auWriter writes the access units from a depacketizer to the camera.
+type auWriter struct {
+	c      *camera
+	d      *h264Depacketizer
+	lastTS uint32
+	haveTS bool
+	err    error // from the last write
+}
+
+func (w *auWriter) emit(au [][]byte, ts uint32) {
+	if len(w.d.sps) == 0 || len(w.d.pps) == 0 {
+		// can't decode anything without them.
+		return
+	}
+	var duration time.Duration
+	if w.haveTS && ts-w.lastTS < 10*90000 {
+		duration = time.Duration(ts-w.lastTS) * time.Second / 90000
+	}
+	w.lastTS, w.haveTS = ts, true
+	w.err = w.c.writeFrame(frame{
+		data:     annexB(au, w.d.sps, w.d.pps),
+		duration: duration,
+		keyframe: isKeyframe(au),
+	})
+}
+
+// listenRTPPair opens udp sockets on a pair of consecutive ports, the
+// first even, for rtp and rtcp. they listen on ip, or on every address
+// if it's nil.
+func listenRTPPair(ip net.IP) (rtpConn, rtcpConn *net.UDPConn, err error) {
+	for i := 0; i < 10; i++ {
+		rtpConn, err = net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+		if err != nil {
+			return nil, nil, err
+		}
+		port := rtpConn.LocalAddr().(*net.UDPAddr).Port
+		if port%2 == 0 {
+			rtcpConn, err = net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port + 1})
+			if err == nil {
+				return rtpConn, rtcpConn, nil
+			}
+		}
+		rtpConn.Close()
+	}
+	return nil, nil, fmt.Errorf("could not find a free pair of udp ports")
+}
+
+// serverRTCPPort returns the camera's rtcp port from a unicast Transport
+// header, or 0 if it didn't say.
+func serverRTCPPort(transport string) int {
+	for _, p := range strings.Split(transport, ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		if k != "server_port" {
+			continue
+		}
+		rtpport, rtcpport, ok := strings.Cut(v, "-")
+		if !ok {
+			// just the rtp port. rtcp is the one after.
+			n, err := strconv.Atoi(rtpport)
+			if err != nil || n <= 0 {
+				return 0
+			}
+			return n + 1
+		}
+		n, _ := strconv.Atoi(rtcpport)
+		return n
+	}
+	return 0
+}
+
+// multicastDestination returns the group and rtp port from a multicast
+// Transport header.
+func multicastDestination(transport string) (net.IP, int, error) {
+	var group net.IP
+	var port int
+	for _, p := range strings.Split(transport, ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		switch k {
+		case "destination":
+			group = net.ParseIP(v)
+		case "port":
+			rtpport, _, _ := strings.Cut(v, "-")
+			port, _ = strconv.Atoi(rtpport)
+		}
+	}
+	if group == nil || !group.IsMulticast() || port <= 0 {
+		return nil, 0, fmt.Errorf("no multicast destination in transport %q", transport)
+	}
+	return group, port, nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// playback of recordings over rtsp, at rtsp://<dnvr>/<id>/playback, or
+// .../playback?start=<time> to start somewhere other than the oldest one.
+// times are rtsp clock times, e.g. 20240601T150405Z, or rfc 3339.
+// recordings play one after another with the gaps between them skipped.
+// clients can seek with Range, in npt from the start or in clock time,
+// fast forward with Scale, and PAUSE.
+
+const (
+	maxScale = 16
+
+	// frames further apart than this are in different recordings, or
+	// either side of a seek, and are played as if they were adjacent.
+	maxPlaybackStep = 10 * time.Second
+)
+
+// rtspPlayback is a session's place in a camera's recordings.
+type rtspPlayback struct {
+	camera   string
+	start    time.Time // npt 0
+	position time.Time // of the last frame sent
+	scale    float64
+}
+
+// newRTSPPlayback starts playback at start, or at the oldest recording if
+// start is zero.
+func newRTSPPlayback(camera string, start time.Time) *rtspPlayback {
+	p := &rtspPlayback{camera: camera, start: start, scale: 1}
+	if recs := p.recordings(); start.IsZero() && len(recs) > 0 {
+		p.start = recs[0].Time
+	}
+	p.position = p.start
+	return p
+}
+
+// setStart takes the start of playback from req's url, if it says.
+func (s *rtspConn) setStart(req *request) error {
+	v := req.URL.Query().Get("start")
+	if v == "" {
+		return nil
+	}
+	t, err := parseClock(v)
+	if err != nil {
+		return err
+	}
+	s.start = t
+	return nil
+}
+
+// recordings returns the camera's recordings, oldest first.
+func (p *rtspPlayback) recordings() []recording {
+	all, err := readRecordings()
+	if err != nil {
+		log.Printf("could not list recordings: %v", err)
+	}
+	var recs []recording
+	for _, rec := range all {
+		if rec.Camera == p.camera {
+			recs = append(recs, rec)
+		}
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].Time.Before(recs[j].Time) })
+	return recs
+}
+
+// firstRecording returns the index of the recording t might be in, or of
+// the first one after t.
+func firstRecording(recs []recording, t time.Time) int {
+	i := sort.Search(len(recs), func(i int) bool { return recs[i].Time.After(t) })
+	if i > 0 {
+		i--
+	}
+	return i
+}
+
+// sdp describes the video from where playback starts, or returns nil if
+// there's nothing to play.
+func (p *rtspPlayback) sdp() []byte {
+	recs := p.recordings()
+	for i := firstRecording(recs, p.position); i < len(recs); i++ {
+		m, err := openMP4(filepath.Join(outDir, filepath.FromSlash(recs[i].Name)))
+		if err != nil {
+			continue
+		}
+		m.Close()
+		return videoSDP(p.camera, m.codec.SPS(), m.codec.PPS(), "npt=0-")
+	}
+	return nil
+}
+
+// play takes a PLAY's Range and Scale, and puts what we made of them in
+// resp. We can't play backwards, so negative scales are ignored.
+func (p *rtspPlayback) play(req *request, resp *response) {
+	if t, ok := parseRange(req.Header.Get("Range"), p.start); ok {
+		p.position = t
+	}
+	if scale, err := strconv.ParseFloat(strings.TrimSpace(req.Header.Get("Scale")), 64); err == nil && scale > 0 {
+		if scale > maxScale {
+			scale = maxScale
+		}
+		p.scale = scale
+	}
+	if npt := p.position.Sub(p.start); npt >= 0 {
+		resp.Header.Set("Range", fmt.Sprintf("npt=%.3f-", npt.Seconds()))
+	} else {
+		resp.Header.Set("Range", "clock="+p.position.UTC().Format("20060102T150405.000Z")+"-")
+	}
+	resp.Header.Set("Scale", strconv.FormatFloat(p.scale, 'f', -1, 64))
+}
+
+// playbackSource reads a camera's recordings one after another, from the
+// playback's position, paced by their timestamps and its scale.
+type playbackSource struct {
+	p    *rtspPlayback
+	recs []recording
+	i    int        // the recording being played
+	m    *mp4Frames // open, if we've started on it
+	due  time.Time  // when the last frame was due
+	last time.Time  // and its time
+}
+
+func (p *rtspPlayback) frames() frameSource {
+	recs := p.recordings()
+	return &playbackSource{p: p, recs: recs, i: firstRecording(recs, p.position)}
+}
+
+func (s *playbackSource) next(ctx context.Context) (frame, error) {
+	for {
+		if s.m == nil {
+			if s.i >= len(s.recs) {
+				return frame{}, io.EOF
+			}
+			rec := s.recs[s.i]
+			m, err := openMP4(filepath.Join(outDir, filepath.FromSlash(rec.Name)))
+			if err != nil {
+				// most likely still being recorded.
+				s.i++
+				continue
+			}
+			if off := s.p.position.Sub(rec.Time); off > 0 {
+				if err := m.demuxer.SeekToTime(off); err != nil {
+					m.Close()
+					s.i++
+					continue
+				}
+			}
+			s.m = m
+		}
+		f, t, err := s.m.next()
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("could not read %s: %v", s.recs[s.i].Name, err)
+			}
+			s.m.Close()
+			s.m = nil
+			s.i++
+			continue
+		}
+
+		at := s.recs[s.i].Time.Add(t)
+		step := at.Sub(s.last)
+		switch {
+		case s.last.IsZero():
+			step, s.due = 0, time.Now()
+		case step < 0 || step > maxPlaybackStep:
+			step = time.Second / defaultFileFPS
+		}
+		s.last = at
+		f.duration = time.Duration(float64(step) / s.p.scale)
+		s.due = s.due.Add(f.duration)
+		select {
+		case <-ctx.Done():
+			return frame{}, ctx.Err()
+		case <-time.After(time.Until(s.due)):
+		}
+		s.p.position = at
+		return f, nil
+	}
+}
+
+func (s *playbackSource) close() {
+	if s.m != nil {
+		s.m.Close()
+	}
+}
+
+// parseRange returns where a Range header asks to play from, with npt
+// counted from start. It doesn't do smpte.
+func parseRange(h string, start time.Time) (time.Time, bool) {
+	h, _, _ = strings.Cut(h, ";")
+	unit, v, _ := strings.Cut(strings.TrimSpace(h), "=")
+	from, _, _ := strings.Cut(v, "-")
+	from = strings.TrimSpace(from)
+	switch unit {
+	case "npt":
+		if from == "" || from == "now" {
+			return time.Time{}, false
+		}
+		d, err := parseNPT(from)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return start.Add(d), true
+	case "clock":
+		t, err := parseClock(from)
+		return t, err == nil
+	}
+	return time.Time{}, false
+}
+
+// parseNPT parses normal play time, in seconds or h:mm:ss, either with a
+// fraction.
+func parseNPT(s string) (time.Duration, error) {
+	var secs float64
+	for _, part := range strings.Split(s, ":") {
+		f, err := strconv.ParseFloat(part, 64)
+		if err != nil || f < 0 {
+			return 0, fmt.Errorf("bad npt %q", s)
+		}
+		secs = secs*60 + f
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+// parseClock parses an rtsp clock time, e.g. 20240601T150405.25Z, or an
+// rfc 3339 time.
+func parseClock(s string) (time.Time, error) {
+	if t, err := time.Parse("20060102T150405Z", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,738 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+)
+
+// rtsp server to allow things that can't speak webrtc, like vlc or another
+// nvr, access to the cameras. it serves the frames we already get, so
+// however many clients there are each camera only sees us. cameras' acls
+// apply as they do for the web ui, and clients log in if there are any
+// config.RTSPUsers.
+// rtsp://<dnvr>/<id> is a camera, rtsp://<dnvr>/<id>/sub its substream.
+// clients can also tunnel over http, see rtsptunnel.go.
+
+const (
+	rtspSessionTimeout = 60 * time.Second
+	rtspWriteTimeout   = 10 * time.Second
+	rtspMTU            = 1400
+	rtspPayloadType    = 96
+)
+
+var rtspStatusText = map[int]string{
+	200: "OK",
+	400: "Bad Request",
+	401: "Unauthorized",
+	404: "Not Found",
+	454: "Session Not Found",
+	455: "Method Not Valid in This State",
+	459: "Aggregate Operation Not Allowed",
+	461: "Unsupported Transport",
+	501: "Not Implemented",
+	503: "Service Unavailable",
+}
+
+func rtspListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if config.RTSPCert != "" {
+		cert, err := tls.LoadX509KeyPair(config.RTSPCert, config.RTSPKey)
+		if err != nil {
+			return err
+		}
+		l = tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+	tunnels := &connListener{conns: make(chan net.Conn), addr: l.Addr()}
+	go http.Serve(tunnels, http.HandlerFunc(serveRTSPTunnel))
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			log.Printf("accept error: %v", err.Error())
+			continue
+		}
+		go func() {
+			// rtsp over http starts with an http GET or POST, and rtsp
+			// with any other method.
+			bc := &bufferedConn{Conn: c, r: bufio.NewReader(c)}
+			c.SetReadDeadline(time.Now().Add(rtspSessionTimeout))
+			b, err := bc.r.Peek(5)
+			if err != nil {
+				c.Close()
+				return
+			}
+			if string(b) == "POST " || string(b[:4]) == "GET " {
+				tunnels.conns <- bc
+				return
+			}
+			serveRTSP(bc)
+		}()
+	}
+}
+
+// rtspConn is a client's connection. It carries at most one session, with
+// the video interleaved or over udp.
+type rtspConn struct {
+	lastSeen int64 // unix nanoseconds, accessed atomically. first for alignment.
+
+	conn net.Conn
+	tls  bool
+
+	nonce string // for digest auth
+	user  string // once they've logged in
+
+	wmu sync.Mutex // serialises writes to w
+	w   *bufio.Writer
+
+	start time.Time // from a playback url's start=, for npt 0
+
+	// the session, from SETUP on.
+	session  string
+	cam      *camera
+	playback *rtspPlayback // if it's of recordings rather than live
+	trackURL string
+	channel  byte     // for rtp over tcp
+	udp      *rtspUDP // for rtp over udp
+	ssrc     uint32
+	seq      uint16
+	ts       uint32
+	pausedAt time.Time
+	stop     func() // stops PLAY, nil unless we're playing
+}
+
+func serveRTSP(conn net.Conn) {
+	s := &rtspConn{conn: conn, w: bufio.NewWriter(conn)}
+	s.tls = isTLS(conn)
+	defer conn.Close()
+	defer func() {
+		if s.stop != nil {
+			s.stop()
+		}
+		s.closeUDP()
+	}()
+
+	r := bufio.NewReader(conn)
+	for {
+		if s.stop == nil {
+			// playing over tcp keeps the session alive by itself, and
+			// over udp watchUDP looks after it.
+			conn.SetReadDeadline(time.Now().Add(rtspSessionTimeout))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		b, err := r.Peek(1)
+		if err != nil {
+			return
+		}
+		if b[0] == '$' {
+			// receiver reports, which we have no use for.
+			if _, _, err := readInterleaved(r); err != nil {
+				return
+			}
+			continue
+		}
+		req, err := readRequest(r)
+		if err != nil {
+			log.Printf("%s: could not parse request: %v", conn.RemoteAddr(), err)
+			return
+		}
+		log.Printf("%s	%s	%s\n", conn.RemoteAddr(), req.Method, req.URL.Redacted())
+		atomic.StoreInt64(&s.lastSeen, time.Now().UnixNano())
+
+		resp, then := s.handle(req)
+		resp.Header.Set("CSeq", req.Header.Get("CSeq"))
+		if s.session != "" {
+			resp.Header.Set("Session", s.session+";timeout="+strconv.Itoa(int(rtspSessionTimeout.Seconds())))
+		}
+		if err := s.write(func(w io.Writer) error { return resp.Write(w) }); err != nil {
+			return
+		}
+		if then != nil {
+			then()
+		}
+	}
+}
+
+// write writes to the connection, flushing and giving up if the client
+// doesn't keep up.
+func (s *rtspConn) write(f func(w io.Writer) error) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(rtspWriteTimeout))
+	if err := f(s.w); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+// sendRTP sends packets to the client, however it asked for them.
+func (s *rtspConn) sendRTP(pkts [][]byte) error {
+	if u := s.udp; u != nil {
+		for _, b := range pkts {
+			if _, err := u.rtp.WriteToUDP(b, u.clientRTP); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return s.write(func(w io.Writer) error {
+		for _, b := range pkts {
+			if err := writeInterleaved(w, s.channel, b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// rtspUDP is a session's rtp over udp.
+type rtspUDP struct {
+	rtp, rtcp             *net.UDPConn // ours
+	clientRTP, clientRTCP *net.UDPAddr
+	done                  chan struct{}
+}
+
+// setupUDP gets ready to send rtp over udp. It only ever goes to the
+// address the client connected from, whatever it says, so we can't be
+// made to send video at someone else.
+func (s *rtspConn) setupUDP(t clientTransport) error {
+	host, _, err := net.SplitHostPort(s.conn.RemoteAddr().String())
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("can not send udp to %s", host)
+	}
+	if s.udp == nil {
+		rtpConn, rtcpConn, err := listenRTPPair(nil)
+		if err != nil {
+			return err
+		}
+		s.udp = &rtspUDP{rtp: rtpConn, rtcp: rtcpConn, done: make(chan struct{})}
+		go s.watchUDP(s.udp, ip)
+	}
+	s.udp.clientRTP = &net.UDPAddr{IP: ip, Port: t.rtpPort}
+	s.udp.clientRTCP = &net.UDPAddr{IP: ip, Port: t.rtcpPort}
+	return nil
+}
+
+func (s *rtspConn) closeUDP() {
+	if s.udp == nil {
+		return
+	}
+	close(s.udp.done)
+	s.udp.rtp.Close()
+	s.udp.rtcp.Close()
+	s.udp = nil
+}
+
+// watchUDP ends the session if the client goes quiet. Requests and
+// receiver reports both count as signs of life.
+func (s *rtspConn) watchUDP(u *rtspUDP, client net.IP) {
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			_, addr, err := u.rtcp.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if addr.IP.Equal(client) {
+				atomic.StoreInt64(&s.lastSeen, time.Now().UnixNano())
+			}
+		}
+	}()
+	t := time.NewTicker(rtspSessionTimeout / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-u.done:
+			return
+		case <-t.C:
+		}
+		if time.Since(time.Unix(0, atomic.LoadInt64(&s.lastSeen))) > rtspSessionTimeout {
+			log.Printf("%s: rtsp session timed out", s.conn.RemoteAddr())
+			s.conn.Close()
+			return
+		}
+	}
+}
+
+func rtspResponse(code int) *response {
+	return &response{
+		Proto:      "RTSP/1.0",
+		StatusCode: code,
+		Status:     fmt.Sprintf("%d %s", code, rtspStatusText[code]),
+		Header:     textproto.MIMEHeader{},
+	}
+}
+
+// handle answers a request. then, if not nil, is to be run once the
+// response has been sent.
+func (s *rtspConn) handle(req *request) (resp *response, then func()) {
+	if req.Method != "OPTIONS" && !s.authorized(req) {
+		return s.challenge(), nil
+	}
+	if req.Method != "OPTIONS" && req.Method != "DESCRIBE" && req.Method != "SETUP" &&
+		s.session != "" && sessionID(req) != s.session {
+		return rtspResponse(454), nil
+	}
+
+	switch req.Method {
+	case "OPTIONS":
+		resp = rtspResponse(200)
+		resp.Header.Set("Public", "OPTIONS, DESCRIBE, SETUP, PLAY, PAUSE, TEARDOWN, GET_PARAMETER")
+		return resp, nil
+
+	case "DESCRIBE":
+		c, playback := rtspCamera(req.URL.Path, s.conn.RemoteAddr().String())
+		if c == nil {
+			return rtspResponse(404), nil
+		}
+		var sdp []byte
+		if playback {
+			if err := s.setStart(req); err != nil {
+				return rtspResponse(400), nil
+			}
+			sdp = newRTSPPlayback(c.id, s.start).sdp()
+			if sdp == nil {
+				return rtspResponse(404), nil
+			}
+		} else {
+			sdp = c.sdp()
+		}
+		base := *req.URL
+		base.User, base.RawQuery = nil, ""
+		if !strings.HasSuffix(base.Path, "/") {
+			base.Path += "/"
+		}
+		resp = rtspResponse(200)
+		resp.Header.Set("Content-Base", base.String())
+		resp.Header.Set("Content-Type", "application/sdp")
+		resp.Body = sdp
+		return resp, nil
+
+	case "SETUP":
+		c, playback := rtspCamera(req.URL.Path, s.conn.RemoteAddr().String())
+		if c == nil {
+			return rtspResponse(404), nil
+		}
+		if s.cam != nil && (s.cam != c || playback != (s.playback != nil)) {
+			return rtspResponse(459), nil
+		}
+		if s.session != "" && sessionID(req) != s.session {
+			return rtspResponse(454), nil
+		}
+		t, ok := parseTransport(req.Header.Get("Transport"))
+		if !ok {
+			return rtspResponse(461), nil
+		}
+		if s.stop != nil {
+			return rtspResponse(455), nil
+		}
+		if s.session == "" {
+			var b [8]byte
+			rand.Read(b[:])
+			s.session = hex.EncodeToString(b[:])
+			s.ssrc = binary.BigEndian.Uint32(b[:4])
+			s.seq = binary.BigEndian.Uint16(b[4:6])
+			s.ts = binary.BigEndian.Uint32(b[4:])
+		}
+		resp = rtspResponse(200)
+		if t.tcp {
+			s.closeUDP()
+			s.channel = t.channel
+			resp.Header.Set("Transport", fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d;ssrc=%08X", t.channel, t.channel+1, s.ssrc))
+		} else {
+			if err := s.setupUDP(t); err != nil {
+				log.Printf("%s: %v", s.conn.RemoteAddr(), err)
+				return rtspResponse(461), nil
+			}
+			resp.Header.Set("Transport", fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d;server_port=%d-%d;ssrc=%08X",
+				t.rtpPort, t.rtcpPort, s.udp.rtp.LocalAddr().(*net.UDPAddr).Port, s.udp.rtcp.LocalAddr().(*net.UDPAddr).Port, s.ssrc))
+		}
+		if playback && s.playback == nil {
+			if err := s.setStart(req); err != nil {
+				return rtspResponse(400), nil
+			}
+			s.playback = newRTSPPlayback(c.id, s.start)
+		}
+		s.cam = c
+		u := *req.URL
+		u.User = nil
+		s.trackURL = u.String()
+		return resp, nil
+
+	case "PLAY":
+		if s.cam == nil {
+			return rtspResponse(455), nil
+		}
+		resp = rtspResponse(200)
+		if s.playback != nil {
+			// seeking or changing speed starts over.
+			if s.stop != nil && (req.Header.Get("Range") != "" || req.Header.Get("Scale") != "") {
+				s.stop()
+			}
+			if s.stop == nil {
+				s.playback.play(req, resp)
+			}
+		}
+		if s.stop != nil {
+			// already playing.
+			return resp, nil
+		}
+		if !s.pausedAt.IsZero() {
+			s.ts += uint32(time.Since(s.pausedAt) * 90000 / time.Second)
+		}
+		var open func() frameSource
+		if p := s.playback; p != nil {
+			open = func() frameSource { return p.frames() }
+		} else {
+			c := s.cam
+			resp.Header.Set("Range", "npt=now-")
+			open = func() frameSource { return c.liveFrames() }
+		}
+		owner := s.cam
+		if owner.parent != nil {
+			// substreams count against their camera's caps.
+			owner = owner.parent
+		}
+		if err := owner.addPlayer(); err != nil {
+			log.Printf("%s: %v", s.conn.RemoteAddr(), err)
+			return rtspResponse(503), nil
+		}
+		resp.Header.Set("RTP-Info", fmt.Sprintf("url=%s;seq=%d;rtptime=%d", s.trackURL, s.seq, s.ts))
+		return resp, s.play(open, owner.removePlayer)
+
+	case "PAUSE":
+		if s.cam == nil {
+			return rtspResponse(455), nil
+		}
+		if s.stop != nil {
+			s.stop()
+			s.pausedAt = time.Now()
+		}
+		return rtspResponse(200), nil
+
+	case "TEARDOWN":
+		if s.stop != nil {
+			s.stop()
+		}
+		resp = rtspResponse(200)
+		s.closeUDP()
+		s.session, s.cam, s.playback = "", nil, nil
+		return resp, nil
+
+	case "GET_PARAMETER":
+		// keepalives.
+		return rtspResponse(200), nil
+	}
+	return rtspResponse(501), nil
+}
+
+// frameSource is what a session plays.
+type frameSource interface {
+	// next waits for the next frame. It returns io.EOF if there won't be
+	// any more.
+	next(ctx context.Context) (frame, error)
+	close()
+}
+
+// liveSource is a camera's frames as they come in.
+type liveSource struct {
+	c    *camera
+	sink *frameSink
+}
+
+func (c *camera) liveFrames() frameSource {
+	return &liveSource{c: c, sink: c.addSink()}
+}
+
+func (l *liveSource) next(ctx context.Context) (frame, error) {
+	select {
+	case <-ctx.Done():
+		return frame{}, ctx.Err()
+	case f := <-l.sink.frames:
+		return f, nil
+	}
+}
+
+func (l *liveSource) close() {
+	l.c.removeSink(l.sink)
+}
+
+// play returns a func that starts sending the session's video from the
+// source open returns, to call once the client has the response to PLAY.
+// It can be stopped with s.stop, and calls stopped once it has.
+func (s *rtspConn) play(open func() frameSource, stopped func()) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	s.stop = func() {
+		cancel()
+		<-done
+		s.stop = nil
+	}
+	start := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer stopped()
+		select {
+		case <-ctx.Done():
+			return
+		case <-start:
+		}
+		src := open()
+		defer src.close()
+		var p codecs.H264Payloader
+		first := true
+		for {
+			f, err := src.next(ctx)
+			if err != nil {
+				return
+			}
+			if !first {
+				s.ts += uint32(f.duration * 90000 / time.Second)
+			}
+			first = false
+			payloads := p.Payload(rtspMTU, f.data)
+			pkts := make([][]byte, 0, len(payloads))
+			for i, payload := range payloads {
+				pkt := rtp.Packet{
+					Header: rtp.Header{
+						Version:        2,
+						Marker:         i == len(payloads)-1,
+						PayloadType:    rtspPayloadType,
+						SequenceNumber: s.seq,
+						Timestamp:      s.ts,
+						SSRC:           s.ssrc,
+					},
+					Payload: payload,
+				}
+				s.seq++
+				b, err := pkt.Marshal()
+				if err != nil {
+					continue
+				}
+				pkts = append(pkts, b)
+			}
+			err = s.sendRTP(pkts)
+			if err != nil {
+				// the read loop will notice.
+				s.conn.Close()
+				return
+			}
+		}
+	}()
+	return func() { close(start) }
+}
+
+// rtspCamera returns the camera, or substream, an rtsp url's path is for,
+// if addr may see it. playback is set for paths to the camera's
+// recordings.
+func rtspCamera(path, addr string) (c *camera, playback bool) {
+	p := strings.Trim(path, "/")
+	p = strings.TrimSuffix(strings.TrimSuffix(p, "trackID=0"), "/")
+	if id := strings.TrimSuffix(p, "/playback"); id != p {
+		if c, ok := getCamera(id); ok && c.addrAllowed(addr) {
+			return c, true
+		}
+	}
+	if c, ok := getCamera(p); ok && c.addrAllowed(addr) {
+		return c, false
+	}
+	if id := strings.TrimSuffix(p, "/sub"); id != p {
+		if c, ok := getCamera(id); ok && c.sub != nil && c.addrAllowed(addr) {
+			return c.sub, false
+		}
+	}
+	return nil, false
+}
+
+// sessionID returns the id from a request's Session header.
+func sessionID(req *request) string {
+	id, _, _ := strings.Cut(req.Header.Get("Session"), ";")
+	return strings.TrimSpace(id)
+}
+
+// clientTransport is how a client wants its rtp.
+type clientTransport struct {
+	tcp               bool
+	channel           byte // for tcp
+	rtpPort, rtcpPort int  // for udp
+}
+
+// parseTransport picks the first thing we can do from a client's
+// Transport header, which may list several it would take: rtp over tcp,
+// or unicast rtp over udp.
+func parseTransport(transport string) (clientTransport, bool) {
+	for _, t := range strings.Split(transport, ",") {
+		params := strings.Split(strings.TrimSpace(t), ";")
+		switch strings.ToUpper(params[0]) {
+		case "RTP/AVP/TCP":
+			ch := interleavedChannel(t)
+			if ch < 255 {
+				return clientTransport{tcp: true, channel: ch}, true
+			}
+		case "RTP/AVP", "RTP/AVP/UDP":
+			ct := clientTransport{}
+			multicast := false
+			for _, p := range params[1:] {
+				k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+				switch k {
+				case "multicast":
+					multicast = true
+				case "client_port":
+					rtpPort, rtcpPort, ok := strings.Cut(v, "-")
+					ct.rtpPort, _ = strconv.Atoi(rtpPort)
+					ct.rtcpPort = ct.rtpPort + 1
+					if ok {
+						ct.rtcpPort, _ = strconv.Atoi(rtcpPort)
+					}
+				}
+			}
+			if !multicast && ct.rtpPort > 0 && ct.rtpPort < 1<<16 && ct.rtcpPort > 0 && ct.rtcpPort < 1<<16 {
+				return ct, true
+			}
+		}
+	}
+	return clientTransport{}, false
+}
+
+// sdp describes the camera's video as we serve it.
+func (c *camera) sdp() []byte {
+	sps, pps := c.parameterSets()
+	return videoSDP(c.id, sps, pps, "npt=now-")
+}
+
+// videoSDP describes h.264 video as we serve it. sps and pps may be nil if
+// we haven't seen them yet, since they're in band as well.
+func videoSDP(name string, sps, pps []byte, rng string) []byte {
+	fmtp := "packetization-mode=1"
+	if len(sps) >= 4 {
+		fmtp += fmt.Sprintf(";profile-level-id=%02X%02X%02X", sps[1], sps[2], sps[3])
+	}
+	if sps != nil && pps != nil {
+		fmtp += ";sprop-parameter-sets=" + base64.StdEncoding.EncodeToString(sps) + "," + base64.StdEncoding.EncodeToString(pps)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "v=0\r\n")
+	fmt.Fprintf(&b, "o=- %d 1 IN IP4 0.0.0.0\r\n", time.Now().Unix())
+	fmt.Fprintf(&b, "s=%s\r\n", name)
+	fmt.Fprintf(&b, "c=IN IP4 0.0.0.0\r\n")
+	fmt.Fprintf(&b, "t=0 0\r\n")
+	fmt.Fprintf(&b, "a=control:*\r\n")
+	fmt.Fprintf(&b, "a=range:%s\r\n", rng)
+	fmt.Fprintf(&b, "m=video 0 RTP/AVP %d\r\n", rtspPayloadType)
+	fmt.Fprintf(&b, "a=rtpmap:%d H264/90000\r\n", rtspPayloadType)
+	fmt.Fprintf(&b, "a=fmtp:%d %s\r\n", rtspPayloadType, fmtp)
+	fmt.Fprintf(&b, "a=control:trackID=0\r\n")
+	return []byte(b.String())
+}
+
+const rtspRealm = "dnvr"
+
+// authorized reports whether the client has logged in as one of
+// config.RTSPUsers, or doesn't need to.
+func (s *rtspConn) authorized(req *request) bool {
+	if len(config.RTSPUsers) == 0 || s.user != "" {
+		return true
+	}
+	user, ok := checkAuthorization(req, s.nonce, s.tls)
+	if !ok {
+		if req.Header.Get("Authorization") != "" {
+			log.Printf("%s: wrong rtsp credentials for %q", s.conn.RemoteAddr(), user)
+		}
+		return false
+	}
+	s.user = user
+	return true
+}
+
+// challenge asks the client to log in. basic auth would send passwords in
+// the clear, so it's only offered over rtsps.
+func (s *rtspConn) challenge() *response {
+	if s.nonce == "" {
+		var b [16]byte
+		rand.Read(b[:])
+		s.nonce = hex.EncodeToString(b[:])
+	}
+	resp := rtspResponse(401)
+	resp.Header.Add("WWW-Authenticate", fmt.Sprintf("Digest realm=%s, nonce=%s, algorithm=MD5", quote(rtspRealm), quote(s.nonce)))
+	if s.tls {
+		resp.Header.Add("WWW-Authenticate", "Basic realm="+quote(rtspRealm))
+	}
+	return resp
+}
+
+// checkAuthorization checks a request's Authorization header against
+// config.RTSPUsers, returning the username it's for.
+func checkAuthorization(req *request, nonce string, basic bool) (string, bool) {
+	h := req.Header.Get("Authorization")
+	scheme, rest, _ := strings.Cut(h, " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(rest))
+		if err != nil {
+			return "", false
+		}
+		user, password, _ := strings.Cut(string(b), ":")
+		want, ok := config.RTSPUsers[user]
+		return user, basic && ok && subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1
+
+	case "digest":
+		cs := parseChallenges([]string{h})
+		if len(cs) != 1 {
+			return "", false
+		}
+		p := cs[0].params
+		user := p["username"]
+		password, ok := config.RTSPUsers[user]
+		newHash, sess := digestAlgorithm(p["algorithm"])
+		if !ok || newHash == nil || nonce == "" || p["nonce"] != nonce || p["realm"] != rtspRealm {
+			return user, false
+		}
+		// the response is only good for the url it was made for. clients
+		// send either the whole url, or just its path.
+		if uri := p["uri"]; uri != req.RequestURI && uri != req.URL.RequestURI() {
+			return user, false
+		}
+		hash := func(s string) string {
+			h := newHash()
+			io.WriteString(h, s)
+			return hex.EncodeToString(h.Sum(nil))
+		}
+		ha1 := hash(user + ":" + rtspRealm + ":" + password)
+		if sess {
+			ha1 = hash(ha1 + ":" + nonce + ":" + p["cnonce"])
+		}
+		ha2 := hash(req.Method + ":" + p["uri"])
+		want := hash(ha1 + ":" + nonce + ":" + ha2)
+		if qop := p["qop"]; qop != "" {
+			want = hash(ha1 + ":" + nonce + ":" + p["nc"] + ":" + p["cnonce"] + ":" + qop + ":" + ha2)
+		}
+		return user, subtle.ConstantTimeCompare([]byte(p["response"]), []byte(want)) == 1
+	}
+	return "", false
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/textproto"
+	"net/url"
+	"testing"
+)
+
+func TestCheckAuthorizationURI(t *testing.T) {
+	defer func(u map[string]string) { config.RTSPUsers = u }(config.RTSPUsers)
+	config.RTSPUsers = map[string]string{"alice": "secret"}
+
+	const nonce = "0123456789abcdef"
+	a := newAuthenticator(url.UserPassword("alice", "secret"))
+	a.challenge(&response{Header: textproto.MIMEHeader{
+		"Www-Authenticate": {`Digest realm="dnvr", nonce="` + nonce + `", algorithm=MD5`},
+	}})
+	for _, tt := range []struct {
+		requestURI, uri string
+		ok              bool
+	}{
+		{"rtsp://dnvr:8554/front", "rtsp://dnvr:8554/front", true},
+		{"rtsp://dnvr:8554/front", "/front", true},
+		{"rtsp://dnvr:8554/front/trackID=0", "rtsp://dnvr:8554/front/trackID=0", true},
+		{"rtsp://dnvr:8554/back", "rtsp://dnvr:8554/front", false},
+		{"rtsp://dnvr:8554/back", "/front", false},
+		{"rtsp://dnvr:8554/front/trackID=0", "rtsp://dnvr:8554/front", false},
+	} {
+		u, err := url.ParseRequestURI(tt.requestURI)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := &request{
+			Method:     "DESCRIBE",
+			RequestURI: tt.requestURI,
+			URL:        u,
+			Header:     textproto.MIMEHeader{"Authorization": {a.authorization("DESCRIBE", tt.uri, nil)}},
+		}
+		user, ok := checkAuthorization(req, nonce, false)
+		if ok != tt.ok || user != "alice" {
+			t.Errorf("%s with digest uri %s: %q, %v, want alice, %v", tt.requestURI, tt.uri, user, ok, tt.ok)
+		}
+	}
+}
+
+func TestParseTransport(t *testing.T) {
+	for _, tt := range []struct {
+		transport string
+		want      clientTransport
+		ok        bool
+	}{
+		{"RTP/AVP/TCP;unicast;interleaved=0-1", clientTransport{tcp: true, channel: 0}, true},
+		{"RTP/AVP/TCP;unicast;interleaved=4-5", clientTransport{tcp: true, channel: 4}, true},
+		{"rtp/avp/tcp;interleaved=2", clientTransport{tcp: true, channel: 2}, true},
+		{"RTP/AVP/TCP;unicast;interleaved=255", clientTransport{}, false},
+		{"RTP/AVP;unicast;client_port=5000-5001", clientTransport{rtpPort: 5000, rtcpPort: 5001}, true},
+		{"RTP/AVP/UDP;unicast;client_port=5000", clientTransport{rtpPort: 5000, rtcpPort: 5001}, true},
+		{"RTP/AVP;multicast;client_port=5000-5001", clientTransport{}, false},
+		{"RTP/AVP;unicast", clientTransport{}, false},
+		{"RTP/AVP;unicast;client_port=70000-70001", clientTransport{}, false},
+		{"RTP/AVP;unicast;client_port=65535", clientTransport{}, false},
+		{"RTP/SAVP;unicast;client_port=5000-5001", clientTransport{}, false},
+		// the first one we can do wins.
+		{"RTP/AVP;multicast, RTP/AVP;unicast;client_port=6000-6001, RTP/AVP/TCP;interleaved=0-1",
+			clientTransport{rtpPort: 6000, rtcpPort: 6001}, true},
+		{"RTP/SAVP;unicast,RTP/AVP/TCP;interleaved=0-1", clientTransport{tcp: true}, true},
+		{"", clientTransport{}, false},
+	} {
+		got, ok := parseTransport(tt.transport)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseTransport(%q) = %+v, %v, want %+v, %v", tt.transport, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRTSPPlayTakesViewerSlot(t *testing.T) {
+	defer func(u map[string]string) { config.RTSPUsers = u }(config.RTSPUsers)
+	config.RTSPUsers = nil
+	c := &camera{id: "capped", maxViewers: 1}
+	cameras.Lock()
+	cameras.m[c.id] = c
+	cameras.Unlock()
+	defer func() {
+		cameras.Lock()
+		delete(cameras.m, c.id)
+		cameras.Unlock()
+	}()
+
+	newConn := func() *rtspConn {
+		conn, other := net.Pipe()
+		t.Cleanup(func() { conn.Close(); other.Close() })
+		return &rtspConn{conn: conn, w: bufio.NewWriter(conn)}
+	}
+	do := func(s *rtspConn, method, transport string) int {
+		u, err := url.Parse("rtsp://dnvr:8554/capped/trackID=0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := textproto.MIMEHeader{}
+		if transport != "" {
+			h.Set("Transport", transport)
+		}
+		if s.session != "" {
+			h.Set("Session", s.session)
+		}
+		resp, _ := s.handle(&request{Method: method, RequestURI: u.String(), URL: u, Header: h})
+		return resp.StatusCode
+	}
+	play := func(s *rtspConn) int {
+		if code := do(s, "SETUP", "RTP/AVP/TCP;unicast;interleaved=0-1"); code != 200 {
+			t.Fatalf("SETUP: %d", code)
+		}
+		return do(s, "PLAY", "")
+	}
+
+	a, b := newConn(), newConn()
+	if code := play(a); code != 200 {
+		t.Fatalf("first PLAY: %d", code)
+	}
+	if code := play(b); code != 503 {
+		t.Errorf("PLAY past the cap: %d, want 503", code)
+	}
+	do(a, "TEARDOWN", "")
+	if code := do(b, "PLAY", ""); code != 200 {
+		t.Errorf("PLAY after the first one hung up: %d, want 200", code)
+	}
+	b.stop()
+	c.RLock()
+	defer c.RUnlock()
+	if c.players != 0 {
+		t.Errorf("%d slots still taken", c.players)
+	}
+}
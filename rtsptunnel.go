@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// rtsp over http, apple's way, for clients on networks that only let http
+// out. the client makes two http connections with the same x-sessioncookie:
+// a GET, whose response is everything the server sends back, and a POST,
+// whose body is its requests, base64 encoded. it works on the rtsp
+// listener, and on the web ui's port, as rtsp://<dnvr>:80/<id> with vlc's
+// --rtsp-http, say.
+
+const rtspTunnelTimeout = 10 * time.Second // for the POST to follow its GET
+
+// rtspTunnels are the GETs waiting for their POSTs, by session cookie.
+var rtspTunnels = struct {
+	sync.Mutex
+	m map[string]chan *rtspTunnel
+}{m: map[string]chan *rtspTunnel{}}
+
+// rtspTunnel is a GET and a POST put together into one connection for
+// serveRTSP.
+type rtspTunnel struct {
+	net.Conn // the GET, which responses and rtp go out on
+	post     net.Conn
+	r        *bufio.Reader // the POST's body
+	buf      []byte        // decoded, not yet read
+}
+
+// Read decodes the POST's body. Clients encode a request at a time, so
+// there may be padding in the middle.
+func (t *rtspTunnel) Read(p []byte) (int, error) {
+	for len(t.buf) == 0 {
+		var quad [4]byte
+		for n := 0; n < len(quad); {
+			c, err := t.r.ReadByte()
+			if err != nil {
+				return 0, err
+			}
+			switch c {
+			case '\r', '\n', ' ', '\t':
+				continue
+			}
+			quad[n] = c
+			n++
+		}
+		var b [3]byte
+		n, err := base64.StdEncoding.Decode(b[:], quad[:])
+		if err != nil {
+			return 0, err
+		}
+		t.buf = append(t.buf[:0], b[:n]...)
+	}
+	n := copy(p, t.buf)
+	t.buf = t.buf[n:]
+	return n, nil
+}
+
+func (t *rtspTunnel) Close() error {
+	t.post.Close()
+	return t.Conn.Close()
+}
+
+func (t *rtspTunnel) SetDeadline(d time.Time) error {
+	t.post.SetReadDeadline(d)
+	return t.Conn.SetWriteDeadline(d)
+}
+
+func (t *rtspTunnel) SetReadDeadline(d time.Time) error {
+	return t.post.SetReadDeadline(d)
+}
+
+// isRTSPTunnel says whether an http request is half of a tunnel.
+func isRTSPTunnel(r *http.Request) bool {
+	return r.Header.Get("X-Sessioncookie") != "" && (r.Method == http.MethodGet || r.Method == http.MethodPost)
+}
+
+// rtspTunnelling serves tunnels, and passes anything else on to h.
+func rtspTunnelling(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isRTSPTunnel(r) {
+			serveRTSPTunnel(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func serveRTSPTunnel(w http.ResponseWriter, r *http.Request) {
+	cookie := r.Header.Get("X-Sessioncookie")
+	if !isRTSPTunnel(r) {
+		http.Error(w, "not an rtsp tunnel", http.StatusBadRequest)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "can not tunnel over this connection", http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		rtspTunnels.Lock()
+		get, ok := rtspTunnels.m[cookie]
+		delete(rtspTunnels.m, cookie)
+		rtspTunnels.Unlock()
+		if !ok {
+			http.Error(w, "no GET for this x-sessioncookie", http.StatusNotFound)
+			return
+		}
+		conn, rw, err := hj.Hijack()
+		if err != nil {
+			return
+		}
+		// the POST never gets a response.
+		get <- &rtspTunnel{post: conn, r: rw.Reader}
+		return
+	}
+
+	rtspTunnels.Lock()
+	if _, ok := rtspTunnels.m[cookie]; ok {
+		rtspTunnels.Unlock()
+		http.Error(w, "x-sessioncookie in use", http.StatusConflict)
+		return
+	}
+	post := make(chan *rtspTunnel, 1)
+	rtspTunnels.m[cookie] = post
+	rtspTunnels.Unlock()
+	forget := func() {
+		rtspTunnels.Lock()
+		if rtspTunnels.m[cookie] == post {
+			delete(rtspTunnels.m, cookie)
+		}
+		rtspTunnels.Unlock()
+	}
+	defer forget()
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	rw.WriteString("HTTP/1.0 200 OK\r\n" +
+		"Content-Type: application/x-rtsp-tunnelled\r\n" +
+		"Cache-Control: no-store\r\n" +
+		"Pragma: no-cache\r\n" +
+		"Connection: close\r\n\r\n")
+	conn.SetWriteDeadline(time.Now().Add(rtspWriteTimeout))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	select {
+	case t := <-post:
+		log.Printf("%s: rtsp tunnelled over http", r.RemoteAddr)
+		t.Conn = conn
+		serveRTSP(t)
+	case <-time.After(rtspTunnelTimeout):
+		log.Printf("%s: rtsp tunnel GET with no POST", r.RemoteAddr)
+		conn.Close()
+		forget()
+		select {
+		case t := <-post:
+			// it only just made it.
+			t.post.Close()
+		default:
+		}
+	}
+}
+
+// bufferedConn is a connection that's been peeked at.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// connListener is a net.Listener for connections accepted elsewhere.
+type connListener struct {
+	conns chan net.Conn
+	addr  net.Addr
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	c, ok := <-l.conns
+	if !ok {
+		return nil, errors.New("listener closed")
+	}
+	return c, nil
+}
+
+func (l *connListener) Close() error   { return nil }
+func (l *connListener) Addr() net.Addr { return l.addr }
+
+// isTLS says whether conn, under any of our wrappers, is tls.
+func isTLS(conn net.Conn) bool {
+	switch c := conn.(type) {
+	case *tls.Conn:
+		return true
+	case *bufferedConn:
+		return isTLS(c.Conn)
+	case *rtspTunnel:
+		return isTLS(c.Conn)
+	}
+	return false
+}
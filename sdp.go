@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// sessionDesc is the bits of an sdp session description we care about.
+// Cameras are not very good at following the spec so this is much more
+// forgiving than it ought to be.
+type sessionDesc struct {
+	Connection string // c= line, if any
+	Attrs      []string
+	Media      []*mediaDesc
+}
+
+// mediaDesc is a single m= section.
+type mediaDesc struct {
+	Type       string // audio, video, ...
+	Port       int
+	Proto      string
+	Formats    []int // rtp payload types
+	Connection string
+	Attrs      []string // a= lines, without the a=
+}
+
+func parseSDP(b []byte) (*sessionDesc, error) {
+	sd := &sessionDesc{}
+	var md *mediaDesc
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if len(line) < 2 || line[1] != '=' {
+			continue
+		}
+		k, v := line[0], line[2:]
+		switch k {
+		case 'm':
+			fields := strings.Fields(v)
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("malformed media description: %v", line)
+			}
+			port, _, _ := strings.Cut(fields[1], "/")
+			md = &mediaDesc{Type: fields[0], Proto: fields[2]}
+			md.Port, _ = strconv.Atoi(port)
+			for _, f := range fields[3:] {
+				pt, err := strconv.Atoi(f)
+				if err != nil {
+					continue
+				}
+				md.Formats = append(md.Formats, pt)
+			}
+			sd.Media = append(sd.Media, md)
+		case 'c':
+			if md != nil {
+				md.Connection = v
+			} else {
+				sd.Connection = v
+			}
+		case 'a':
+			if md != nil {
+				md.Attrs = append(md.Attrs, v)
+			} else {
+				sd.Attrs = append(sd.Attrs, v)
+			}
+		}
+	}
+	return sd, s.Err()
+}
+
+// attr returns the value of the first attribute named key, e.g.
+// attr("control"). Property attributes like "sendonly" have an empty
+// value.
+func attr(attrs []string, key string) (string, bool) {
+	for _, a := range attrs {
+		k, v, _ := strings.Cut(a, ":")
+		if k == key {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+func (md *mediaDesc) attr(key string) (string, bool) { return attr(md.Attrs, key) }
+
+// rtpmap returns the encoding name and clock rate for payload type pt,
+// e.g. "PCMU", 8000.
+func (md *mediaDesc) rtpmap(pt int) (string, int) {
+	for _, a := range md.Attrs {
+		k, v, _ := strings.Cut(a, ":")
+		if k != "rtpmap" {
+			continue
+		}
+		ptstr, enc, _ := strings.Cut(v, " ")
+		if ptstr != strconv.Itoa(pt) {
+			continue
+		}
+		name, rate, _ := strings.Cut(enc, "/")
+		rate, _, _ = strings.Cut(rate, "/")
+		r, _ := strconv.Atoi(rate)
+		return name, r
+	}
+	// static payload types don't need an rtpmap.
+	switch pt {
+	case 0:
+		return "PCMU", 8000
+	case 8:
+		return "PCMA", 8000
+	}
+	return "", 0
+}
+
+// fmtp returns the format parameters for payload type pt as a map.
+func (md *mediaDesc) fmtp(pt int) map[string]string {
+	params := map[string]string{}
+	for _, a := range md.Attrs {
+		k, v, _ := strings.Cut(a, ":")
+		if k != "fmtp" {
+			continue
+		}
+		ptstr, ps, _ := strings.Cut(v, " ")
+		if ptstr != strconv.Itoa(pt) {
+			continue
+		}
+		for _, p := range strings.Split(ps, ";") {
+			k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+			if k != "" {
+				params[strings.ToLower(k)] = v
+			}
+		}
+	}
+	return params
+}
+
+// controlURL resolves the media's a=control against base, which should
+// be the Content-Base of the DESCRIBE response or the request URL.
+func (md *mediaDesc) controlURL(base *url.URL) (*url.URL, error) {
+	ctl, ok := md.attr("control")
+	if !ok || ctl == "*" {
+		return base, nil
+	}
+	if strings.HasPrefix(ctl, "rtsp://") || strings.HasPrefix(ctl, "rtsps://") {
+		return url.Parse(ctl)
+	}
+	// relative to base, which is taken to be a directory even if it has
+	// no trailing slash. that's what everyone seems to do.
+	b := *base
+	if !strings.HasSuffix(b.Path, "/") {
+		b.Path += "/"
+	}
+	return b.Parse(ctl)
+}
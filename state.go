@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// states a camera's connection can be in.
+const (
+	stateConnecting       = "connecting"
+	stateWaiting          = "waiting" // for a device to push to us
+	stateStreaming        = "streaming"
+	stateStalled          = "stalled"     // connected, but no frames lately
+	stateBackingOff       = "backing-off" // waiting to reconnect after an error
+	stateFailedAuth       = "failed-auth"
+	stateUnsupportedCodec = "unsupported-codec"
+	stateEnded            = "ended" // a file source that doesn't loop
+)
+
+const (
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute
+
+	// how long without frames before a streaming camera counts as
+	// stalled.
+	stallTimeout = 5 * time.Second
+
+	// how long without frames before we give up on the connection and
+	// make a new one, unless the source says otherwise.
+	defaultStallReconnect = 10 * time.Second
+)
+
+// errUnsupportedCodec is for sources that don't have any h.264 video.
+var errUnsupportedCodec = errors.New("unsupported codec")
+
+// cameraState is where a camera's connection is at, and why.
+type cameraState struct {
+	State string
+	Error string     `json:",omitempty"` // the last error
+	Since time.Time  // when State was entered
+	Retry *time.Time `json:",omitempty"` // when we'll reconnect, if we're waiting to
+}
+
+func (c *camera) getState() cameraState {
+	c.RLock()
+	defer c.RUnlock()
+	return c.state
+}
+
+// setState moves the camera to a new state. err is kept as the last
+// error, if there is one.
+func (c *camera) setState(state string, err error, retry time.Time) {
+	c.Lock()
+	s := c.state
+	if s.State != state {
+		s.State, s.Since = state, time.Now()
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	s.Retry = nil
+	if !retry.IsZero() {
+		s.Retry = &retry
+	}
+	changed := s.State != c.state.State || s.Error != c.state.Error
+	c.state = s
+	c.Unlock()
+
+	if !changed {
+		return
+	}
+	if err != nil {
+		log.Printf("%s: %s: %v", c.id, state, err)
+	} else {
+		log.Printf("%s: %s", c.id, state)
+	}
+	if c.parent == nil {
+		// a substream's state is only in the api.
+		c.emit("state", s)
+	}
+}
+
+// gotFrame notes that a frame arrived, for stall detection and stats.
+func (c *camera) gotFrame(f frame) {
+	now := time.Now()
+	atomic.StoreInt64(&c.lastFrame, now.UnixNano())
+	c.stats.frame(f, now)
+}
+
+// watchFrames flips the camera between streaming and stalled depending on
+// whether frames are arriving, until ctx is done. If there's no video for
+// the camera's stallReconnect it calls cancel, to have the connection
+// dropped and made again, and closes stalled to say why.
+func (c *camera) watchFrames(ctx context.Context, cancel func(), stalled chan<- struct{}) {
+	start := time.Now()
+	quietAfter := stallTimeout
+	if 2*c.pollInterval > quietAfter {
+		// snapshots are slow.
+		quietAfter = 2 * c.pollInterval
+	}
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		last := atomic.LoadInt64(&c.lastFrame)
+		since := start
+		if last != 0 {
+			since = time.Unix(0, last)
+		}
+		if time.Since(since) > c.stallReconnect {
+			close(stalled)
+			cancel()
+			return
+		}
+		if last == 0 {
+			continue
+		}
+		state := c.getState().State
+		quiet := time.Since(since) > quietAfter
+		switch {
+		case quiet && state == stateStreaming:
+			c.setState(stateStalled, errors.New("no frames"), time.Time{})
+		case !quiet && state != stateStreaming:
+			c.setState(stateStreaming, nil, time.Time{})
+		}
+	}
+}
+
+// failureState works out which state a failed connection attempt leaves
+// the camera in.
+func failureState(err error) string {
+	var se *statusError
+	if errors.As(err, &se) && (se.StatusCode == 401 || se.StatusCode == 403) {
+		return stateFailedAuth
+	}
+	if errors.Is(err, errUnsupportedCodec) {
+		return stateUnsupportedCodec
+	}
+	return stateBackingOff
+}
+
+// backoff returns how long to wait before the nth retry in a row. it
+// doubles each time, with jitter so cameras that went down together don't
+// all come back at once.
+func backoff(n int) time.Duration {
+	d := maxBackoff
+	if n < 20 {
+		d = minBackoff << uint(n)
+		if d > maxBackoff {
+			d = maxBackoff
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// statsWindow is how far back the rolling stats look.
+const statsWindow = 5 * time.Second
+
+// streamStats describes a camera's video over the last statsWindow.
+type streamStats struct {
+	FPS              float64
+	Bitrate          float64   // bits per second
+	GOP              int       // frames in the last complete gop
+	KeyframeInterval float64   // seconds between the last two keyframes
+	MaxGap           float64   // longest wait between two frames, in seconds
+	RTP              *rtpStats `json:",omitempty"` // for rtp over udp
+}
+
+type frameSample struct {
+	t    time.Time
+	size int
+}
+
+// statsTracker keeps the numbers streamStats is worked out from. It has
+// its own lock so it stays off the camera's, which viewers contend for.
+type statsTracker struct {
+	mu          sync.Mutex
+	window      []frameSample
+	gopFrames   int // since the last keyframe
+	lastGOP     int
+	lastKey     time.Time
+	keyInterval time.Duration
+	rtp         *rtpStats
+}
+
+func (s *statsTracker) frame(f frame, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.trim(now)
+	s.window = append(s.window, frameSample{t: now, size: len(f.data)})
+	if f.keyframe {
+		if !s.lastKey.IsZero() {
+			s.lastGOP = s.gopFrames
+			s.keyInterval = now.Sub(s.lastKey)
+		}
+		s.lastKey = now
+		s.gopFrames = 0
+	}
+	s.gopFrames++
+}
+
+func (s *statsTracker) setRTP(rs rtpStats) {
+	s.mu.Lock()
+	s.rtp = &rs
+	s.mu.Unlock()
+}
+
+// reset forgets everything, for a new connection.
+func (s *statsTracker) reset() {
+	s.mu.Lock()
+	s.window = nil
+	s.gopFrames, s.lastGOP = 0, 0
+	s.lastKey, s.keyInterval = time.Time{}, 0
+	s.rtp = nil
+	s.mu.Unlock()
+}
+
+func (s *statsTracker) trim(now time.Time) {
+	i := 0
+	for i < len(s.window) && now.Sub(s.window[i].t) > statsWindow {
+		i++
+	}
+	s.window = append(s.window[:0], s.window[i:]...)
+}
+
+func (s *statsTracker) stats(now time.Time) streamStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.trim(now)
+	st := streamStats{
+		GOP:              s.lastGOP,
+		KeyframeInterval: s.keyInterval.Seconds(),
+	}
+	if s.rtp != nil {
+		rs := *s.rtp
+		st.RTP = &rs
+	}
+	if len(s.window) == 0 {
+		return st
+	}
+	bytes := 0
+	prev := s.window[0].t
+	for _, f := range s.window {
+		bytes += f.size
+		if gap := f.t.Sub(prev).Seconds(); gap > st.MaxGap {
+			st.MaxGap = gap
+		}
+		prev = f.t
+	}
+	if gap := now.Sub(prev).Seconds(); gap > st.MaxGap {
+		// still waiting for the next one.
+		st.MaxGap = gap
+	}
+	secs := statsWindow.Seconds()
+	st.FPS = float64(len(s.window)) / secs
+	st.Bitrate = float64(bytes*8) / secs
+	return st
+}
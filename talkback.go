@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// talkback relays audio from a viewer's microphone to the camera's
+// speaker, over the onvif rtsp audio backchannel. see section 5.3 of the
+// onvif streaming spec.
+
+const (
+	backchannelRequire = "www.onvif.org/ver20/backchannel"
+
+	// hang up on the camera after this long without audio from the
+	// browser. the browser stops sending when the talk button is let go.
+	talkbackIdleTimeout = 5 * time.Second
+)
+
+// backchannel is an rtsp session for sending audio to a camera.
+type backchannel struct {
+	*rtspClient
+	channel  byte
+	pt       uint8
+	encoding string // PCMU or PCMA
+	ssrc     uint32
+	seq      uint16
+}
+
+func dialBackchannel(src string, tlsConfig *tls.Config) (*backchannel, error) {
+	c, err := dialRTSP(src, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	bc := &backchannel{rtspClient: c, ssrc: rand.Uint32()}
+	err = bc.setup()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return bc, nil
+}
+
+func (bc *backchannel) setup() error {
+	bc.Header.Set("Require", backchannelRequire)
+
+	sd, base, err := bc.describe()
+	if err != nil {
+		return err
+	}
+
+	var md *mediaDesc
+	for _, m := range sd.Media {
+		if _, ok := m.attr("sendonly"); ok && m.Type == "audio" {
+			md = m
+			break
+		}
+	}
+	if md == nil {
+		return fmt.Errorf("no audio backchannel in sdp")
+	}
+	for _, pt := range md.Formats {
+		enc, rate := md.rtpmap(pt)
+		enc = strings.ToUpper(enc)
+		if (enc == "PCMU" || enc == "PCMA") && rate == 8000 {
+			bc.pt, bc.encoding = uint8(pt), enc
+			break
+		}
+	}
+	if bc.encoding == "" {
+		return fmt.Errorf("backchannel has no g.711 payload type: %v", md.Formats)
+	}
+
+	ctl, err := md.controlURL(base)
+	if err != nil {
+		return err
+	}
+	resp, err := bc.do("SETUP", ctl, textproto.MIMEHeader{
+		"Transport": {"RTP/AVP/TCP;unicast;interleaved=0-1"},
+	})
+	if err != nil {
+		return err
+	}
+	bc.channel = interleavedChannel(resp.Header.Get("Transport"))
+
+	_, err = bc.do("PLAY", base, textproto.MIMEHeader{"Range": {"npt=0.000-"}})
+	return err
+}
+
+// interleavedChannel returns the rtp channel from a Transport header, or
+// 0 if there isn't one.
+func interleavedChannel(transport string) byte {
+	for _, p := range strings.Split(transport, ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		if k != "interleaved" {
+			continue
+		}
+		rtpch, _, _ := strings.Cut(v, "-")
+		ch, err := strconv.Atoi(rtpch)
+		if err == nil && ch >= 0 && ch < 256 {
+			return byte(ch)
+		}
+	}
+	return 0
+}
+
+// write sends an rtp packet from the browser to the camera, converting
+// it to the camera's flavour of g.711 if need be.
+func (bc *backchannel) write(p *rtp.Packet, encoding string) error {
+	payload := append([]byte(nil), p.Payload...)
+	transcodeG711(payload, encoding, bc.encoding)
+	out := rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Marker:         p.Marker,
+			PayloadType:    bc.pt,
+			SequenceNumber: bc.seq,
+			Timestamp:      p.Timestamp,
+			SSRC:           bc.ssrc,
+		},
+		Payload: payload,
+	}
+	bc.seq++
+	buf, err := out.Marshal()
+	if err != nil {
+		return err
+	}
+	return bc.writeInterleaved(bc.channel, buf)
+}
+
+func (bc *backchannel) close() {
+	bc.send("TEARDOWN", nil, nil)
+	bc.Close()
+}
+
+// relayTalkback forwards audio from t to the camera until t ends. Only one
+// viewer may talk to a camera at a time.
+func (c *camera) relayTalkback(t *webrtc.TrackRemote) {
+	encoding := strings.ToUpper(strings.TrimPrefix(t.Codec().MimeType, "audio/"))
+	if encoding != "PCMU" && encoding != "PCMA" {
+		log.Printf("talkback to %s: unsupported codec %v", c.id, t.Codec().MimeType)
+		return
+	}
+
+	packets := make(chan *rtp.Packet, 100)
+	go func() {
+		defer close(packets)
+		for {
+			p, _, err := t.ReadRTP()
+			if err != nil {
+				return
+			}
+			packets <- p
+		}
+	}()
+
+	var bc *backchannel
+	hangup := func() {
+		if bc != nil {
+			bc.close()
+			bc = nil
+			c.talk.Unlock()
+		}
+	}
+	defer hangup()
+
+	var retry time.Time
+	idle := time.NewTimer(talkbackIdleTimeout)
+	defer idle.Stop()
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case p, ok := <-packets:
+			if !ok {
+				return
+			}
+			if bc == nil {
+				if time.Now().Before(retry) || !c.talk.TryLock() {
+					// broken camera, or someone else is talking.
+					continue
+				}
+				var err error
+				bc, err = dialBackchannel(c.src, c.tlsConfig)
+				if err != nil {
+					log.Printf("could not open backchannel to %s: %v", c.id, err)
+					c.talk.Unlock()
+					// don't try again for every packet.
+					retry = time.Now().Add(30 * time.Second)
+					continue
+				}
+				go bc.discard()
+			}
+			idle.Reset(talkbackIdleTimeout)
+			err := bc.write(p, encoding)
+			if err != nil {
+				log.Printf("could not send audio to %s: %v", c.id, err)
+				hangup()
+			}
+		case <-idle.C:
+			hangup()
+		case <-keepalive.C:
+			if bc != nil {
+				bc.send("GET_PARAMETER", nil, nil)
+			}
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// fakeCamera is an rtsp server on a local port that answers requests with
+// handle, and passes on whatever is sent to it interleaved.
+type fakeCamera struct {
+	url         string
+	requests    chan *request
+	interleaved chan []byte
+}
+
+func newFakeCamera(t *testing.T, handle func(req *request) *response) *fakeCamera {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	fc := &fakeCamera{
+		url:         "rtsp://" + l.Addr().String() + "/stream",
+		requests:    make(chan *request, 16),
+		interleaved: make(chan []byte, 16),
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			b, err := r.Peek(1)
+			if err != nil {
+				return
+			}
+			if b[0] == '$' {
+				_, data, err := readInterleaved(r)
+				if err != nil {
+					return
+				}
+				fc.interleaved <- data
+				continue
+			}
+			req, err := readRequest(r)
+			if err != nil {
+				return
+			}
+			fc.requests <- req
+			resp := handle(req)
+			resp.Header.Set("CSeq", req.Header.Get("CSeq"))
+			if err := resp.Write(conn); err != nil {
+				return
+			}
+		}
+	}()
+	return fc
+}
+
+func fakeResponse(code int) *response {
+	return &response{
+		Proto:      "RTSP/1.0",
+		StatusCode: code,
+		Status:     fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		Header:     textproto.MIMEHeader{},
+	}
+}
+
+const backchannelSDP = "v=0\r\n" +
+	"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+	"s=cam\r\n" +
+	"t=0 0\r\n" +
+	"m=video 0 RTP/AVP 96\r\n" +
+	"a=rtpmap:96 H264/90000\r\n" +
+	"a=control:track1\r\n" +
+	"a=recvonly\r\n" +
+	"m=audio 0 RTP/AVP 0\r\n" +
+	"a=rtpmap:0 PCMU/8000\r\n" +
+	"a=control:track2\r\n" +
+	"a=recvonly\r\n" +
+	"m=audio 0 RTP/AVP 97 8\r\n" +
+	"a=rtpmap:97 L16/16000\r\n" +
+	"a=rtpmap:8 PCMA/8000\r\n" +
+	"a=control:track3\r\n" +
+	"a=sendonly\r\n"
+
+func TestBackchannel(t *testing.T) {
+	fc := newFakeCamera(t, func(req *request) *response {
+		resp := fakeResponse(200)
+		switch req.Method {
+		case "DESCRIBE":
+			if req.Header.Get("Require") != backchannelRequire {
+				return fakeResponse(551)
+			}
+			resp.Header.Set("Content-Type", "application/sdp")
+			resp.Body = []byte(backchannelSDP)
+		case "SETUP":
+			resp.Header.Set("Session", "12345678")
+			resp.Header.Set("Transport", "RTP/AVP/TCP;unicast;interleaved=4-5")
+		}
+		return resp
+	})
+
+	bc, err := dialBackchannel(fc.url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []struct{ method, url string }{
+		{"DESCRIBE", fc.url},
+		{"SETUP", fc.url + "/track3"},
+		{"PLAY", fc.url},
+	} {
+		req := <-fc.requests
+		if req.Method != want.method || req.URL.String() != want.url {
+			t.Errorf("got %s %s, want %s %s", req.Method, req.URL, want.method, want.url)
+		}
+		if want.method == "PLAY" && req.Header.Get("Session") != "12345678" {
+			t.Errorf("PLAY without the session: %v", req.Header)
+		}
+	}
+	if bc.encoding != "PCMA" || bc.pt != 8 || bc.channel != 4 {
+		t.Fatalf("backchannel is %s pt %d on channel %d, want PCMA pt 8 on channel 4", bc.encoding, bc.pt, bc.channel)
+	}
+
+	// the browser sends mu-law, the camera wants a-law.
+	in := &rtp.Packet{
+		Header:  rtp.Header{Version: 2, PayloadType: 0, SequenceNumber: 7, Timestamp: 160, SSRC: 1, Marker: true},
+		Payload: []byte{0xff, 0x80, 0x00},
+	}
+	for i := 0; i < 2; i++ {
+		if err := bc.write(in, "PCMU"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var seq uint16
+	for i := 0; i < 2; i++ {
+		var p rtp.Packet
+		select {
+		case data := <-fc.interleaved:
+			if err := p.Unmarshal(data); err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no audio at the camera")
+		}
+		if p.PayloadType != 8 || p.Timestamp != 160 || !p.Marker || p.SSRC != bc.ssrc {
+			t.Errorf("bad header: %+v", p.Header)
+		}
+		if want := []byte{0xd5, 0xaa, 0x2a}; string(p.Payload) != string(want) {
+			t.Errorf("payload %x, want %x", p.Payload, want)
+		}
+		if i > 0 && p.SequenceNumber != seq+1 {
+			t.Errorf("sequence number %d after %d", p.SequenceNumber, seq)
+		}
+		seq = p.SequenceNumber
+	}
+	if in.Payload[0] != 0xff {
+		t.Errorf("write changed the browser's packet")
+	}
+
+	bc.close()
+	select {
+	case req := <-fc.requests:
+		if req.Method != "TEARDOWN" {
+			t.Errorf("got %s, want TEARDOWN", req.Method)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("no TEARDOWN")
+	}
+}
+
+func TestBackchannelWithoutAudio(t *testing.T) {
+	fc := newFakeCamera(t, func(req *request) *response {
+		resp := fakeResponse(200)
+		resp.Header.Set("Content-Type", "application/sdp")
+		resp.Body = []byte("v=0\r\ns=cam\r\nt=0 0\r\nm=video 0 RTP/AVP 96\r\na=rtpmap:96 H264/90000\r\n")
+		return resp
+	})
+	if _, err := dialBackchannel(fc.url, nil); err == nil {
+		t.Error("dialed a backchannel to a camera without one")
+	}
+}
+
+func TestInterleavedChannel(t *testing.T) {
+	for _, tt := range []struct {
+		transport string
+		want      byte
+	}{
+		{"RTP/AVP/TCP;unicast;interleaved=0-1", 0},
+		{"RTP/AVP/TCP;unicast;interleaved=4-5;ssrc=1234", 4},
+		{"RTP/AVP/TCP; interleaved=10", 10},
+		{"RTP/AVP;unicast;client_port=5000-5001", 0},
+		{"RTP/AVP/TCP;interleaved=300-301", 0},
+	} {
+		if got := interleavedChannel(tt.transport); got != tt.want {
+			t.Errorf("interleavedChannel(%q) = %d, want %d", tt.transport, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v3"
+)
+
+// how long a viewer may take to connect, and how long it may stay
+// disconnected before we give up on it and free its peer connection.
+const (
+	viewerConnectTimeout    = 30 * time.Second
+	viewerDisconnectTimeout = 10 * time.Second
+)
+
+var webrtcAPI = newWebRTCAPI()
+
+// newWebRTCAPI is webrtc.NewPeerConnection's setup with our own ICE
+// timeouts and codecs.
+func newWebRTCAPI() *webrtc.API {
+	m := &webrtc.MediaEngine{}
+	// only g.711 for audio, so browsers send talkback audio in something
+	// cameras understand. we only ever send h.264 video.
+	for _, codec := range []webrtc.RTPCodecParameters{
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000}, PayloadType: 0},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMA, ClockRate: 8000}, PayloadType: 8},
+	} {
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeAudio); err != nil {
+			log.Fatalf("could not register codec: %v", err)
+		}
+	}
+	feedback := []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}, {Type: "nack"}, {Type: "nack", Parameter: "pli"}}
+	for i, fmtp := range []string{
+		"level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f",
+		"level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+		"level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=640032",
+	} {
+		codec := webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: fmtp, RTCPFeedback: feedback},
+			PayloadType:        webrtc.PayloadType(102 + i),
+		}
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			log.Fatalf("could not register codec: %v", err)
+		}
+	}
+	i := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		log.Fatalf("could not register interceptors: %v", err)
+	}
+
+	s := webrtc.SettingEngine{}
+	// pion's defaults keep dead peers around for half a minute. we'd
+	// rather notice closed tabs quickly.
+	s.SetICETimeouts(5*time.Second, viewerDisconnectTimeout, 2*time.Second)
+
+	return webrtc.NewAPI(
+		webrtc.WithMediaEngine(m),
+		webrtc.WithInterceptorRegistry(i),
+		webrtc.WithSettingEngine(s),
+	)
+}
+
+var errTooManyViewers = errors.New("too many viewers")
+
+// totalViewers counts viewers across all cameras, to enforce the
+// global cap in config.MaxViewers.
+var totalViewers = struct {
+	sync.Mutex
+	n int
+}{}
+
+// session is a browser's peer connection. It carries a single camera, or
+// all of them for the grid view.
+type session struct {
+	pc         *webrtc.PeerConnection
+	remoteAddr string
+
+	mu      sync.Mutex
+	dc      *webrtc.DataChannel
+	viewers map[string]*viewer // by camera id
+	closed  bool
+
+	neg     sync.Mutex // held for the duration of a renegotiation
+	answers chan webrtc.SessionDescription
+}
+
+// viewer is one camera being sent to a session.
+type viewer struct {
+	c      *camera
+	s      *session
+	track  *webrtc.TrackLocalStaticSample
+	sender *webrtc.RTPSender
+
+	// protected by c's lock.
+	live     bool            // getting frames from writeFrame
+	catching bool            // goLive is sending it a gop
+	sub      bool            // watching c's substream
+	events   map[string]bool // subscribed events
+	detached bool
+}
+
+func newSession(remoteAddr string) (*session, error) {
+	pc, err := webrtcAPI.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, err
+	}
+	s := &session{
+		pc:         pc,
+		remoteAddr: remoteAddr,
+		viewers:    map[string]*viewer{},
+		answers:    make(chan webrtc.SessionDescription, 1),
+	}
+
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		s.mu.Lock()
+		s.dc = dc
+		s.mu.Unlock()
+		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+			s.handle(msg.Data)
+		})
+		dc.OnClose(func() {
+			s.mu.Lock()
+			if s.dc == dc {
+				s.dc = nil
+			}
+			s.mu.Unlock()
+		})
+	})
+
+	watchConnection(pc, "session from "+remoteAddr, s.close)
+	return s, nil
+}
+
+// close tears down the peer connection and frees its viewer slots. It is
+// safe to call more than once.
+func (s *session) close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	vs := s.viewers
+	s.viewers = nil
+	s.dc = nil
+	s.mu.Unlock()
+
+	for _, v := range vs {
+		v.detach()
+	}
+	if err := s.pc.Close(); err != nil {
+		log.Printf("could not close peer connection for %s: %v", s.remoteAddr, err)
+	}
+}
+
+// answer answers the browser's initial offer, sending it cams. Cameras
+// that are at their viewer cap are left out, unless none of them could
+// be added, in which case that's an error. talkTo maps the mids of the
+// offer's audio transceivers to the cameras they should talk to.
+func (s *session) answer(offer webrtc.SessionDescription, cams []*camera, talkTo func(mid string) *camera) ([]byte, error) {
+	s.pc.OnTrack(func(t *webrtc.TrackRemote, r *webrtc.RTPReceiver) {
+		if t.Kind() != webrtc.RTPCodecTypeAudio {
+			return
+		}
+		for _, tr := range s.pc.GetTransceivers() {
+			if tr.Receiver() == r {
+				if c := talkTo(tr.Mid()); c != nil && c.talkback {
+					c.relayTalkback(t)
+				}
+				return
+			}
+		}
+	})
+
+	err := s.pc.SetRemoteDescription(offer)
+	if err != nil {
+		return nil, err
+	}
+
+	// the offer's recvonly transceivers get reused by AddTrack, in order.
+	var lasterr error
+	for _, c := range cams {
+		_, err := s.attach(c)
+		if err != nil {
+			log.Printf("%s: %v", s.remoteAddr, err)
+			lasterr = err
+		}
+	}
+	s.mu.Lock()
+	n := len(s.viewers)
+	s.mu.Unlock()
+	if n == 0 && lasterr != nil {
+		return nil, lasterr
+	}
+
+	gatherCandidates := webrtc.GatheringCompletePromise(s.pc)
+
+	answer, err := s.pc.CreateAnswer(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.pc.SetLocalDescription(answer)
+	if err != nil {
+		return nil, err
+	}
+
+	<-gatherCandidates
+
+	return json.Marshal(s.pc.LocalDescription())
+}
+
+// attach starts sending c to the session. It returns an error if either
+// the camera's or the global viewer cap has been reached.
+func (s *session) attach(c *camera) (*viewer, error) {
+	s.mu.Lock()
+	_, ok := s.viewers[c.id]
+	s.mu.Unlock()
+	if ok {
+		return nil, fmt.Errorf("already watching %s", c.id)
+	}
+
+	v, err := c.newViewer(s)
+	if err != nil {
+		return nil, err
+	}
+	v.sender, err = s.pc.AddTrack(v.trackLocal())
+	if err != nil {
+		v.detach()
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		v.detach()
+		return nil, errors.New("session closed")
+	}
+	s.viewers[c.id] = v
+	return v, nil
+}
+
+// remove stops sending camera id to the session. The caller has to
+// renegotiate afterwards.
+func (s *session) remove(id string) error {
+	s.mu.Lock()
+	v, ok := s.viewers[id]
+	delete(s.viewers, id)
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("not watching %s", id)
+	}
+	v.detach()
+	return s.pc.RemoveTrack(v.sender)
+}
+
+// renegotiate sends the browser a new offer over the data channel and
+// waits for its answer, which comes back as an "answer" command.
+func (s *session) renegotiate() error {
+	s.neg.Lock()
+	defer s.neg.Unlock()
+
+	offer, err := s.pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	err = s.pc.SetLocalDescription(offer)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-s.answers:
+		// stale.
+	default:
+	}
+	s.send(message{V: protocolVersion, Type: "offer", Data: s.pc.LocalDescription()})
+
+	select {
+	case answer := <-s.answers:
+		return s.pc.SetRemoteDescription(answer)
+	case <-time.After(10 * time.Second):
+		// we're stuck with an offer nobody will answer.
+		s.close()
+		return errors.New("timed out waiting for answer")
+	}
+}
+
+func (s *session) send(msg message) {
+	s.mu.Lock()
+	dc := s.dc
+	s.mu.Unlock()
+	if dc == nil {
+		return
+	}
+	sendMessage(dc, msg)
+}
+
+// newViewer reserves a viewer slot on c for s. It returns an error if
+// either the camera's or the global viewer cap has been reached.
+func (c *camera) newViewer(s *session) (*viewer, error) {
+	totalViewers.Lock()
+	defer totalViewers.Unlock()
+	c.Lock()
+	defer c.Unlock()
+
+	if err := c.checkViewerCaps(); err != nil {
+		return nil, err
+	}
+
+	// each viewer gets its own track so that it can be sent the cached
+	// GOP before it joins the live stream. the stream id tells the
+	// browser which camera it is.
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: "video/h264"}, "v", c.id)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &viewer{c: c, s: s, track: track}
+	if c.viewers == nil {
+		c.viewers = map[*viewer]bool{}
+	}
+	c.viewers[v] = true
+	totalViewers.n++
+	return v, nil
+}
+
+// checkViewerCaps returns an error if c can't take another viewer, live or
+// of a recording. totalViewers' and c's locks must be held.
+func (c *camera) checkViewerCaps() error {
+	if config.MaxViewers > 0 && totalViewers.n >= config.MaxViewers {
+		return fmt.Errorf("%w: limit of %d reached", errTooManyViewers, config.MaxViewers)
+	}
+	if c.maxViewers > 0 && len(c.viewers)+c.players >= c.maxViewers {
+		return fmt.Errorf("%w for %s: limit of %d reached", errTooManyViewers, c.id, c.maxViewers)
+	}
+	return nil
+}
+
+// addPlayer reserves a viewer slot on c for playing one of its
+// recordings, or for an rtsp session playing it. It's given back with
+// removePlayer.
+func (c *camera) addPlayer() error {
+	totalViewers.Lock()
+	defer totalViewers.Unlock()
+	c.Lock()
+	defer c.Unlock()
+	if err := c.checkViewerCaps(); err != nil {
+		return err
+	}
+	c.players++
+	totalViewers.n++
+	return nil
+}
+
+func (c *camera) removePlayer() {
+	totalViewers.Lock()
+	defer totalViewers.Unlock()
+	c.Lock()
+	defer c.Unlock()
+	c.players--
+	totalViewers.n--
+}
+
+// detach stops v getting frames and frees its slot. It is safe to call
+// more than once.
+func (v *viewer) detach() {
+	totalViewers.Lock()
+	defer totalViewers.Unlock()
+	v.c.Lock()
+	defer v.c.Unlock()
+	if v.detached {
+		return
+	}
+	v.detached = true
+	delete(v.c.viewers, v)
+	totalViewers.n--
+}
+
+// watchConnection calls done once pc has failed or closed, stayed
+// disconnected for too long, or never managed to connect at all.
+func watchConnection(pc *webrtc.PeerConnection, name string, done func()) {
+	pc.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		if debug {
+			log.Printf("%s: %s", name, s)
+		}
+		switch s {
+		case webrtc.PeerConnectionStateDisconnected:
+			// usually a closed tab, but it might be a network blip.
+			time.AfterFunc(viewerDisconnectTimeout, func() {
+				if pc.ConnectionState() == webrtc.PeerConnectionStateDisconnected {
+					done()
+				}
+			})
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			done()
+		}
+	})
+
+	time.AfterFunc(viewerConnectTimeout, func() {
+		switch pc.ConnectionState() {
+		case webrtc.PeerConnectionStateNew, webrtc.PeerConnectionStateConnecting:
+			log.Printf("%s did not connect in time", name)
+			done()
+		}
+	})
+}
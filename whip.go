@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// whip ingest, see rfc 9725, so a phone or laptop can publish its webcam
+// from a browser, or obs its output. sources with a whip: url take
+// publishes with their StreamKey as the bearer token. any other id can be
+// published to with config.WHIP.Token, which makes a camera for it. if
+// that publish gets through, the camera sticks around, waiting for its
+// publisher to come back, until we exit.
+
+const (
+	maxOfferSize = 64 << 10
+
+	// browsers only send keyframes when asked. new viewers and recordings
+	// need one every so often, as does the depacketizer after a loss.
+	whipKeyframeInterval = 2 * time.Second
+	whipKeyframeRetry    = 250 * time.Millisecond
+)
+
+// whipSession is a publisher's peer connection.
+type whipSession struct {
+	pc    *webrtc.PeerConnection
+	token string // it was published with, which it needs to hang up
+}
+
+// whipSessions are the publishers, by the resource id they DELETE to
+// hang up.
+var whipSessions = struct {
+	sync.Mutex
+	m map[string]*whipSession
+}{m: map[string]*whipSession{}}
+
+// serveWHIP takes offers at /whip/<id>, and hangups at the resource urls
+// it hands out for them.
+func serveWHIP(w http.ResponseWriter, r *http.Request) {
+	id, session, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/whip/"), "/")
+
+	// publishers can be web pages served from anywhere. they need the
+	// token to do anything.
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "Location")
+
+	switch {
+	case r.Method == http.MethodOptions:
+		w.Header().Set("Access-Control-Allow-Methods", "POST, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		w.WriteHeader(http.StatusNoContent)
+	case session == "" && r.Method == http.MethodPost:
+		publishWHIP(w, r, id)
+	case session != "" && r.Method == http.MethodDelete:
+		whipSessions.Lock()
+		s, ok := whipSessions.m[session]
+		whipSessions.Unlock()
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if !tokenMatches(bearerToken(r), s.token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		s.pc.Close()
+	default:
+		http.Error(w, "unknown method", http.StatusMethodNotAllowed)
+	}
+}
+
+func publishWHIP(w http.ResponseWriter, r *http.Request, id string) {
+	token := bearerToken(r)
+	if token == "" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/sdp" {
+		http.Error(w, "offer must be application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
+	offer, err := ioutil.ReadAll(io.LimitReader(r.Body, maxOfferSize))
+	if err != nil {
+		http.Error(w, "bad times", http.StatusInternalServerError)
+		return
+	}
+	c, fresh, err := whipCamera(id, token)
+	if err != nil {
+		log.Printf("whip from %s: %v", r.RemoteAddr, err)
+		switch {
+		case errors.Is(err, errCameraExists):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, errBadCameraID):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		}
+		return
+	}
+
+	pc, err := webrtcAPI.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		http.Error(w, "bad times", http.StatusInternalServerError)
+		return
+	}
+	var b [16]byte
+	rand.Read(b[:])
+	session := hex.EncodeToString(b[:])
+	whipSessions.Lock()
+	whipSessions.m[session] = &whipSession{pc: pc, token: token}
+	whipSessions.Unlock()
+	var once sync.Once
+	hangup := func() {
+		once.Do(func() {
+			pc.Close()
+			whipSessions.Lock()
+			delete(whipSessions.m, session)
+			whipSessions.Unlock()
+			if fresh {
+				dropWHIPCamera(c)
+			}
+		})
+	}
+	watchConnection(pc, c.id+": whip from "+r.RemoteAddr, hangup)
+
+	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if track.Kind() != webrtc.RTPCodecTypeVideo {
+			// nobody to give the audio to.
+			return
+		}
+		select {
+		case c.published <- func(ctx context.Context) error {
+			log.Printf("%s: whip from %s", c.id, r.RemoteAddr)
+			// someone has published to it, so it's here to stay.
+			cameras.Lock()
+			c.stop = nil
+			cameras.Unlock()
+			defer hangup()
+			return c.readWHIP(ctx, pc, track)
+		}:
+		case <-time.After(publishTimeout):
+			log.Printf("%s: whip from %s: already being published to", c.id, r.RemoteAddr)
+			hangup()
+		}
+	})
+
+	answer, err := whipAnswer(pc, string(offer))
+	if err != nil {
+		hangup()
+		log.Printf("%s: whip from %s: %v", c.id, r.RemoteAddr, err)
+		http.Error(w, "bad offer", http.StatusBadRequest)
+		return
+	}
+	if fresh {
+		err = addWHIPCamera(c)
+		if err != nil {
+			hangup()
+			log.Printf("whip from %s: %v", r.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", "/whip/"+url.PathEscape(c.id)+"/"+session)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer)
+}
+
+// bearerToken returns the token from r's Authorization header, or "" if
+// there isn't one.
+func bearerToken(r *http.Request) string {
+	token := r.Header.Get("Authorization")
+	if !strings.HasPrefix(token, "Bearer ") {
+		return ""
+	}
+	return strings.TrimPrefix(token, "Bearer ")
+}
+
+// whipAnswer answers an offer once all ice candidates have been gathered,
+// since we don't do trickle ice.
+func whipAnswer(pc *webrtc.PeerConnection, offer string) (string, error) {
+	err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer})
+	if err != nil {
+		return "", err
+	}
+	gatherCandidates := webrtc.GatheringCompletePromise(pc)
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	err = pc.SetLocalDescription(answer)
+	if err != nil {
+		return "", err
+	}
+	<-gatherCandidates
+	return pc.LocalDescription().SDP, nil
+}
+
+var (
+	errCameraExists = errors.New("camera exists and isn't a whip source")
+	errBadCameraID  = errors.New("camera ids may only have letters, digits, - and _")
+)
+
+// whipCamera returns the camera a publish to id with token is for. if
+// there isn't one and token is config.WHIP.Token it makes one, and fresh
+// is set. fresh cameras aren't added to cameras, see addWHIPCamera.
+func whipCamera(id, token string) (c *camera, fresh bool, err error) {
+	cameras.RLock()
+	c, ok := cameras.m[id]
+	cameras.RUnlock()
+	if ok {
+		if !strings.HasPrefix(c.src, "whip:") {
+			if tokenMatches(token, config.WHIP.Token) {
+				return nil, false, fmt.Errorf("%w: %s", errCameraExists, id)
+			}
+			return nil, false, fmt.Errorf("no whip source %q", id)
+		}
+		if !tokenMatches(token, c.streamKey) {
+			return nil, false, fmt.Errorf("wrong token for %s", id)
+		}
+		return c, false, nil
+	}
+
+	if !tokenMatches(token, config.WHIP.Token) {
+		return nil, false, fmt.Errorf("no whip source %q", id)
+	}
+	// it ends up in recordings' file names.
+	if id == "" || strings.IndexFunc(id, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_')
+	}) >= 0 {
+		return nil, false, fmt.Errorf("%w: %q", errBadCameraID, id)
+	}
+	src := config.WHIP.Source
+	src.URL = "whip:"
+	src.Type = ""
+	src.StreamKey = config.WHIP.Token
+	c, err = newCamera(id, src)
+	if err != nil {
+		return nil, false, err
+	}
+	return c, true, nil
+}
+
+// addWHIPCamera adds and starts a camera from whipCamera, once its
+// publisher's offer has been answered.
+func addWHIPCamera(c *camera) error {
+	cameras.Lock()
+	defer cameras.Unlock()
+	if _, ok := cameras.m[c.id]; ok {
+		// someone else got there first.
+		return fmt.Errorf("%s was just made by another publish", c.id)
+	}
+	log.Printf("%s: new whip source", c.id)
+	ctx, cancel := context.WithCancel(context.Background())
+	c.stop = cancel
+	cameras.m[c.id] = c
+	c.start(ctx)
+	return nil
+}
+
+// dropWHIPCamera removes a camera addWHIPCamera added, unless someone has
+// published to it since.
+func dropWHIPCamera(c *camera) {
+	cameras.Lock()
+	defer cameras.Unlock()
+	if cameras.m[c.id] != c || c.stop == nil {
+		return
+	}
+	log.Printf("%s: nobody published, dropping it", c.id)
+	delete(cameras.m, c.id)
+	c.stop()
+}
+
+// tokenMatches compares tokens in constant time. Nothing matches an unset
+// token.
+func tokenMatches(token, want string) bool {
+	return want != "" && subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1
+}
+
+// readWHIP reads video from a whip publisher until it hangs up or ctx is
+// done.
+func (c *camera) readWHIP(ctx context.Context, pc *webrtc.PeerConnection, track *webrtc.TrackRemote) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		pc.Close()
+	}()
+
+	if !strings.EqualFold(track.Codec().MimeType, webrtc.MimeTypeH264) {
+		return fmt.Errorf("%w: %s", errUnsupportedCodec, track.Codec().MimeType)
+	}
+
+	var rb reorderBuffer
+	w := &auWriter{c: c, d: &h264Depacketizer{}}
+	var pli time.Time
+	for {
+		if since := time.Since(pli); since > whipKeyframeInterval || w.d.broken && since > whipKeyframeRetry {
+			pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}})
+			pli = time.Now()
+		}
+		p, _, err := track.ReadRTP()
+		if err != nil {
+			return fmt.Errorf("publisher went away: %w", err)
+		}
+		for _, p := range rb.push(p, time.Now()) {
+			w.d.push(p, w.emit)
+		}
+		c.stats.setRTP(rb.rtpStats)
+		if w.err != nil {
+			return fmt.Errorf("can not write frame: %w", w.err)
+		}
+	}
+}
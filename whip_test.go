@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestWHIPDeleteNeedsToken(t *testing.T) {
+	pc, err := webrtcAPI.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	whipSessions.Lock()
+	whipSessions.m["s1"] = &whipSession{pc: pc, token: "secret"}
+	whipSessions.Unlock()
+	defer func() {
+		whipSessions.Lock()
+		delete(whipSessions.m, "s1")
+		whipSessions.Unlock()
+	}()
+
+	hangup := func(path, auth string) int {
+		r := httptest.NewRequest(http.MethodDelete, path, nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		serveWHIP(w, r)
+		return w.Code
+	}
+	for _, tt := range []struct {
+		path, auth string
+		code       int
+	}{
+		{"/whip/cam/s1", "", http.StatusUnauthorized},
+		{"/whip/cam/s1", "Bearer wrong", http.StatusUnauthorized},
+		{"/whip/cam/s1", "Basic c2VjcmV0", http.StatusUnauthorized},
+		{"/whip/cam/s2", "Bearer secret", http.StatusNotFound},
+	} {
+		if code := hangup(tt.path, tt.auth); code != tt.code {
+			t.Errorf("DELETE %s with %q: %d, want %d", tt.path, tt.auth, code, tt.code)
+		}
+	}
+	if pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+		t.Fatal("hung up without the token")
+	}
+	if code := hangup("/whip/cam/s1", "Bearer secret"); code != http.StatusOK {
+		t.Errorf("DELETE with the token: %d, want %d", code, http.StatusOK)
+	}
+	if pc.ConnectionState() != webrtc.PeerConnectionStateClosed {
+		t.Error("still connected after hanging up")
+	}
+}
+
+func TestWHIPDropsUnpublishedCamera(t *testing.T) {
+	defer func(token string) { config.WHIP.Token = token }(config.WHIP.Token)
+	config.WHIP.Token = "secret"
+
+	publish := func(contentType, offer string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/whip/phone", strings.NewReader(offer))
+		r.Header.Set("Authorization", "Bearer secret")
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		serveWHIP(w, r)
+		return w
+	}
+	if w := publish("text/plain", "v=0"); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("offer as text/plain: %d, want %d", w.Code, http.StatusUnsupportedMediaType)
+	}
+	if w := publish("application/sdp", "not sdp"); w.Code != http.StatusBadRequest {
+		t.Errorf("bad offer: %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if _, ok := getCamera("phone"); ok {
+		t.Fatal("made a camera for a publish that went nowhere")
+	}
+
+	pub, err := webrtcAPI.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	_, err = pub.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo,
+		webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer, err := pub.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := publish("application/sdp", offer.SDP)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("publish: %d %s", w.Code, w.Body)
+	}
+	if _, ok := getCamera("phone"); !ok {
+		t.Fatal("no camera for the publish")
+	}
+
+	// hanging up before sending anything leaves nothing behind.
+	r := httptest.NewRequest(http.MethodDelete, w.Header().Get("Location"), nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	serveWHIP(httptest.NewRecorder(), r)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := getCamera("phone"); !ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("camera still there after its publisher hung up")
+}